@@ -0,0 +1,274 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 访问日志格式
+const (
+	ACCESS_LOG_CSV  = "csv"
+	ACCESS_LOG_JSON = "json"
+)
+
+// 连接关闭原因
+const (
+	CLOSE_EOF          = "eof"          // 正常结束
+	CLOSE_IDLE_TIMEOUT = "idle_timeout" // 两个方向都没有数据
+	CLOSE_LIFETIME     = "lifetime"     // 超过最长时间
+	CLOSE_QUOTA        = "quota"        // 流量配额用完
+	CLOSE_NOT_ALLOWED  = "not_allowed"  // 被访问控制, 路由规则或者OnConnect拒绝
+	CLOSE_DIAL_FAIL    = "dial_fail"    // 解析或者连接目标失败
+	CLOSE_ERROR        = "error"        // 其他错误, 见Error
+)
+
+// 访问日志的一条记录, 每个结束的代理连接一条
+type AccessRecord struct {
+	Time     time.Time     `json:"time"` // 连接结束时间
+	ID       ConnID        `json:"conn"`
+	User     string        `json:"user,omitempty"` // 服务端识别出的用户, 客户端为空
+	Source   string        `json:"src"`
+	Host     string        `json:"host"`         // 请求的域名或者IP
+	IP       string        `json:"ip,omitempty"` // 解析后的IP, 客户端只有请求IP时才有
+	Port     int           `json:"port"`
+	Route    string        `json:"route,omitempty"` // 客户端选择的出站, 服务端为空
+	Up       int64         `json:"up"`
+	Down     int64         `json:"down"`
+	Duration time.Duration `json:"-"`
+	Reason   string        `json:"reason"`
+	Error    string        `json:"error,omitempty"`
+
+	start time.Time
+}
+
+var accessLogColumns = []string{"time", "conn", "user", "src", "host", "ip", "port", "route", "up", "down", "duration_ms", "reason", "error"}
+
+func newAccessRecord(source net.Addr, request *Socks5Resolution) *AccessRecord {
+	r := &AccessRecord{Source: source.String(), Reason: CLOSE_EOF, start: time.Now()}
+	if request != nil {
+		r.ID = request.ID
+		r.Host = request.DSTDOMAIN
+		r.Port = int(request.DSTPORT)
+		r.setIP(request)
+	}
+	return r
+}
+
+// 端口转发和反向隧道的记录, 目标为固定地址
+func newForwardRecord(id ConnID, source string, target string) *AccessRecord {
+	r := &AccessRecord{ID: id, Source: source, Reason: CLOSE_EOF, start: time.Now()}
+	host, port, err := net.SplitHostPort(target)
+	if err == nil {
+		r.Host = host
+		r.Port, _ = strconv.Atoi(port)
+		if ip := net.ParseIP(host); ip != nil {
+			r.IP = ip.String()
+		}
+	}
+	return r
+}
+
+// 服务端解析域名后更新IP
+func (r *AccessRecord) setIP(request *Socks5Resolution) {
+	if request.RAWADDR == nil {
+		return
+	}
+	r.IP = request.RAWADDR.IP.String()
+	if len(r.Host) == 0 {
+		r.Host = r.IP
+	}
+}
+
+// 转发之前结束的连接
+func (r *AccessRecord) fail(reason string, err error) {
+	r.Reason = reason
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// 转发结束, 按错误区分关闭原因
+func (r *AccessRecord) done(up int64, down int64, err error) {
+	r.Up, r.Down = up, down
+	switch {
+	case err == nil:
+		r.Reason = CLOSE_EOF
+	case errors.Is(err, errIdleTimeout):
+		r.Reason = CLOSE_IDLE_TIMEOUT
+	case errors.Is(err, errLifetimeExceeded):
+		r.Reason = CLOSE_LIFETIME
+	case errors.Is(err, errQuotaExceeded):
+		r.Reason = CLOSE_QUOTA
+	default:
+		r.fail(CLOSE_ERROR, err)
+	}
+}
+
+// 连接目标失败, 对端拒绝时为not_allowed
+func (r *AccessRecord) dialFail(err error) {
+	if ReplyCode(err) == REP_NOT_ALLOWED {
+		r.fail(CLOSE_NOT_ALLOWED, err)
+	} else {
+		r.fail(CLOSE_DIAL_FAIL, err)
+	}
+}
+
+func (r *AccessRecord) MarshalJSON() ([]byte, error) {
+	type record AccessRecord
+	return json.Marshal(struct {
+		*record
+		DurationMS int64 `json:"duration_ms"`
+	}{(*record)(r), r.Duration.Milliseconds()})
+}
+
+func (r *AccessRecord) csv() []string {
+	return []string{
+		r.Time.Format(time.RFC3339Nano), r.ID.String(), r.User, r.Source, r.Host, r.IP, strconv.Itoa(r.Port), r.Route,
+		strconv.FormatInt(r.Up, 10), strconv.FormatInt(r.Down, 10), strconv.FormatInt(r.Duration.Milliseconds(), 10),
+		r.Reason, r.Error,
+	}
+}
+
+// 访问日志, 写入标准输出或者按大小轮转的文件. CSV格式的文件开头有一行列名
+type AccessLog struct {
+	format string
+
+	mu  sync.Mutex
+	out *rotatingFile
+}
+
+// path为"-"时写入标准输出. maxSize大于0时文件超过maxSize字节后轮转,
+// 旧文件依次改名为path.1, path.2 ..., 最多保留backups个
+func NewAccessLog(path string, format string, maxSize int64, backups int) (*AccessLog, error) {
+	switch format {
+	case "", ACCESS_LOG_CSV:
+		format = ACCESS_LOG_CSV
+	case ACCESS_LOG_JSON:
+	default:
+		return nil, fmt.Errorf("不支持的访问日志格式, %s", format)
+	}
+	out := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if path == "-" {
+		out.f = os.Stdout
+	} else {
+		err := out.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &AccessLog{format: format, out: out}, nil
+}
+
+// 记录结束的连接, l为空时不记录. 写入失败记在连接的logger中
+func (l *AccessLog) write(r *AccessRecord, logger *slog.Logger) {
+	if l == nil {
+		return
+	}
+	r.Time = time.Now()
+	r.Duration = r.Time.Sub(r.start)
+
+	var buf bytes.Buffer
+	if l.format == ACCESS_LOG_JSON {
+		json.NewEncoder(&buf).Encode(r)
+	} else {
+		w := csv.NewWriter(&buf)
+		w.Write(r.csv())
+		w.Flush()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 访问日志出错不影响转发, 轮转失败时继续写入原来的文件
+	err := l.out.rotate(int64(buf.Len()))
+	if err != nil {
+		logger.Error("access log rotate fail", "err", err)
+	}
+	if l.format == ACCESS_LOG_CSV && l.out.size == 0 {
+		w := csv.NewWriter(l.out)
+		w.Write(accessLogColumns)
+		w.Flush()
+	}
+	_, err = l.out.Write(buf.Bytes())
+	if err != nil {
+		logger.Error("access log fail", "err", err)
+	}
+}
+
+// 关闭访问日志文件, l为空或者写入标准输出时什么都不做
+func (l *AccessLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out.f == os.Stdout {
+		return nil
+	}
+	return l.out.f.Close()
+}
+
+// 按大小轮转的文件
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	f       *os.File
+	size    int64
+	renamed bool // 已经改名但是新文件没有打开, 重试时不再改名
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+// 再写入n字节会超过maxSize时轮转. 新文件打不开时保留原来的文件, 下次写入时重试
+func (f *rotatingFile) rotate(n int64) error {
+	if f.maxSize <= 0 || f.f == os.Stdout || f.size == 0 || f.size+n <= f.maxSize {
+		return nil
+	}
+	if !f.renamed {
+		if f.backups > 0 {
+			for i := f.backups - 1; i > 0; i-- {
+				os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+			}
+			os.Rename(f.path, f.path+".1")
+		} else {
+			os.Remove(f.path)
+		}
+		f.renamed = true
+	}
+	old := f.f
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	f.renamed = false
+	old.Close()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,215 @@
+package socks5proxy
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.csv")
+	l, err := NewAccessLog(path, ACCESS_LOG_CSV, 300, 2)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		r := &AccessRecord{ID: ConnID(i), Source: "127.0.0.1:1", Host: "example.com", Port: 443, start: time.Now()}
+		r.done(int64(i), 0, nil)
+		l.write(r, slog.Default())
+	}
+	assert.Nil(t, l.Close())
+
+	// 每个文件都有列名, 最多保留两个旧文件
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		rows := readCSV(t, name)
+		assert.Equal(t, accessLogColumns, rows[0], name)
+		assert.True(t, len(rows) > 1, name)
+		info, _ := os.Stat(name)
+		assert.True(t, info.Size() <= 300, name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+	rows := readCSV(t, path)
+	last := rows[len(rows)-1]
+	assert.Equal(t, ConnID(9).String(), last[1])
+	assert.Equal(t, "example.com", last[4])
+	assert.Equal(t, CLOSE_EOF, last[11])
+
+	_, err = NewAccessLog(path, "xml", 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestAccessLogRotateFail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.csv")
+	l, err := NewAccessLog(path, ACCESS_LOG_CSV, 100, 1)
+	assert.Nil(t, err)
+	r := &AccessRecord{ID: 1, Source: "127.0.0.1:1", Host: "example.com", Port: 443, start: time.Now()}
+	l.write(r, slog.Default())
+
+	// 新文件打不开时继续写入原来的文件
+	l.out.path = filepath.Join(dir, "missing", "access.csv")
+	for i := 2; i <= 3; i++ {
+		r.ID = ConnID(i)
+		l.write(r, slog.Default())
+	}
+	assert.Nil(t, l.Close())
+	rows := readCSV(t, path)
+	assert.Equal(t, 4, len(rows))
+	assert.Equal(t, ConnID(3).String(), rows[3][1])
+}
+
+func TestAccessLogReason(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{nil, CLOSE_EOF},
+		{errIdleTimeout, CLOSE_IDLE_TIMEOUT},
+		{errLifetimeExceeded, CLOSE_LIFETIME},
+		{errQuotaExceeded, CLOSE_QUOTA},
+		{errors.New("reset"), CLOSE_ERROR},
+	} {
+		r := &AccessRecord{}
+		r.done(1, 2, c.err)
+		assert.Equal(t, c.reason, r.Reason)
+	}
+	r := &AccessRecord{}
+	r.dialFail(&ReplyError{Rep: REP_NOT_ALLOWED})
+	assert.Equal(t, CLOSE_NOT_ALLOWED, r.Reason)
+	r.dialFail(&ReplyError{Rep: REP_CONNECTION_REFUSED})
+	assert.Equal(t, CLOSE_DIAL_FAIL, r.Reason)
+}
+
+func TestAccessLog(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dir := t.TempDir()
+	serverLog, err := NewAccessLog(filepath.Join(dir, "server.json"), ACCESS_LOG_JSON, 0, 0)
+	assert.Nil(t, err)
+	clientLog, err := NewAccessLog(filepath.Join(dir, "client.csv"), ACCESS_LOG_CSV, 0, 0)
+	assert.Nil(t, err)
+
+	server, err := NewProxyServer(ServerConfig{
+		EncryType:     "random",
+		Passwd:        "abcedfg17",
+		ServerOptions: ServerOptions{ACL: loopbackACL, AccessLog: serverLog},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go server.Serve(sl)
+	client, err := NewProxyClient(ClientConfig{
+		ServerAddr:    sl.Addr().String(),
+		EncryType:     "random",
+		Passwd:        "abcedfg17",
+		RecvHTTPProto: "sock5",
+		ClientOptions: ClientOptions{
+			Rules:     []string{"127.0.0.1=" + OUTBOUND_PROXY, "blocked.example=" + OUTBOUND_REJECT},
+			AccessLog: clientLog,
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	cl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go client.Serve(cl)
+
+	conn, rep := dialSocks5(cl.Addr().String(), target.Addr().String())
+	assert.Equal(t, byte(REP_SUCCEEDED), rep)
+	echo(t, conn, "hello")
+	conn.Close()
+	// 服务端的ACL拒绝
+	conn, rep = dialSocks5(cl.Addr().String(), "10.255.255.1:80")
+	assert.Equal(t, byte(REP_NOT_ALLOWED), rep)
+	conn.Close()
+	// 客户端的路由规则拒绝
+	conn, rep = dialSocks5(cl.Addr().String(), "blocked.example:80")
+	assert.Equal(t, byte(REP_NOT_ALLOWED), rep)
+	conn.Close()
+
+	assert.Nil(t, client.Shutdown(context.Background()))
+	assert.Nil(t, server.Shutdown(context.Background()))
+	serverLog.Close()
+	clientLog.Close()
+
+	rows := readCSV(t, filepath.Join(dir, "client.csv"))
+	assert.Equal(t, 4, len(rows))
+	byHost := make(map[string][]string)
+	for _, row := range rows[1:] {
+		byHost[row[4]] = row
+	}
+	ok := byHost["127.0.0.1"]
+	assert.Equal(t, OUTBOUND_PROXY, ok[7])
+	assert.Equal(t, []string{"5", "5", CLOSE_EOF}, []string{ok[8], ok[9], ok[11]})
+	assert.Equal(t, CLOSE_NOT_ALLOWED, byHost["10.255.255.1"][11])
+	assert.Equal(t, CLOSE_NOT_ALLOWED, byHost["blocked.example"][11])
+	assert.Equal(t, OUTBOUND_REJECT, byHost["blocked.example"][7])
+
+	data, err := os.ReadFile(filepath.Join(dir, "server.json"))
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+	records := make(map[string]map[string]interface{})
+	for _, line := range lines {
+		var r map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &r))
+		records[r["host"].(string)] = r
+	}
+	// 服务端的记录和客户端使用相同的连接ID
+	r := records["127.0.0.1"]
+	assert.Equal(t, ok[1], r["conn"])
+	assert.Equal(t, DEFAULT_USER, r["user"])
+	assert.Equal(t, "127.0.0.1", r["ip"])
+	assert.Equal(t, float64(5), r["up"])
+	assert.Equal(t, CLOSE_EOF, r["reason"])
+	assert.Contains(t, r, "duration_ms")
+	assert.Equal(t, CLOSE_NOT_ALLOWED, records["10.255.255.1"]["reason"])
+	assert.Equal(t, byHost["10.255.255.1"][1], records["10.255.255.1"]["conn"])
+}
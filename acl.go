@@ -0,0 +1,171 @@
+package socks5proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 默认禁止访问的地址: 本机, 内网, 链路本地(包括云服务器的metadata地址 169.254.169.254), 组播, 保留地址等
+var defaultDeniedNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10", // 运营商级NAT, 阿里云metadata 100.100.100.200
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15", // 测试网络, 常用于内网设备
+	"224.0.0.0/4",   // 组播
+	"240.0.0.0/4",   // 保留
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96", // NAT64, 后32位是IPv4地址, 可以绕过上面的IPv4规则
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// 访问控制规则, 目标可以是:
+//
+//	10.0.0.0/8, 1.2.3.4     IP地址段或IP地址, 按DNS解析后的地址匹配
+//	example.com             域名后缀
+//	port:25, port:6000-7000 目标端口
+type aclRule struct {
+	allow     bool
+	ipNet     *net.IPNet
+	domain    string
+	portStart int
+	portEnd   int
+}
+
+func (r *aclRule) match(domain string, ip net.IP, port int) bool {
+	switch {
+	case r.ipNet != nil:
+		return ip != nil && r.ipNet.Contains(ip)
+	case len(r.domain) > 0:
+		return matchDomain(domain, r.domain)
+	default:
+		return port >= r.portStart && port <= r.portEnd
+	}
+}
+
+// 目标访问控制, 规则按顺序匹配, 第一条匹配的规则生效
+type ACL struct {
+	rules []aclRule
+}
+
+// 解析访问控制规则, 每条为 "allow:目标" 或 "deny:目标", 例如
+//
+//	deny:port:25
+//	allow:10.1.0.0/16
+//	deny:internal.example.com
+func ParseACL(specs []string) (*ACL, error) {
+	acl := &ACL{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+		i := strings.Index(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("访问控制规则格式错误, %s", spec)
+		}
+		var rule aclRule
+		switch spec[:i] {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("访问控制规则格式错误, %s", spec)
+		}
+		target := spec[i+1:]
+
+		if strings.HasPrefix(target, "port:") {
+			lo, hi := target[5:], target[5:]
+			if j := strings.Index(lo, "-"); j >= 0 {
+				lo, hi = lo[:j], lo[j+1:]
+			}
+			start, err := strconv.ParseUint(lo, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("访问控制规则端口错误, %s", spec)
+			}
+			end, err := strconv.ParseUint(hi, 10, 16)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("访问控制规则端口错误, %s", spec)
+			}
+			rule.portStart, rule.portEnd = int(start), int(end)
+		} else if _, n, err := net.ParseCIDR(target); err == nil {
+			rule.ipNet = n
+		} else if ip := net.ParseIP(target); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if len(target) > 0 && !strings.ContainsAny(target, ":/ ") {
+			rule.domain = domainSuffix(target)
+		} else {
+			return nil, fmt.Errorf("访问控制规则目标错误, %s", spec)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+// 规则中的域名后缀, "*.example.com"和".example.com"都按"example.com"处理
+func domainSuffix(s string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(s, "*"), "."))
+}
+
+// domain等于suffix或者是它的子域名, "evilexample.com"不匹配"example.com"
+func matchDomain(domain string, suffix string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
+
+// 按规则检查, 返回是否允许和是否有规则匹配
+func (a *ACL) check(domain string, ip net.IP, port int) (allow bool, matched bool) {
+	if a == nil {
+		return false, false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for i := range a.rules {
+		if a.rules[i].match(domain, ip, port) {
+			return a.rules[i].allow, true
+		}
+	}
+	return false, false
+}
+
+// 检查是否允许访问目标, 先匹配用户规则, 再匹配全局规则, 都没有匹配时禁止内网地址.
+// ip为DNS解析后实际连接的地址, 防止域名解析到内网地址(DNS rebinding)绕过规则
+func AllowDestination(user *User, global *ACL, domain string, ip net.IP, port int) bool {
+	if user != nil {
+		if allow, ok := user.ACL.check(domain, ip, port); ok {
+			return allow
+		}
+	}
+	if allow, ok := global.check(domain, ip, port); ok {
+		return allow
+	}
+	for _, n := range defaultDeniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
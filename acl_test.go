@@ -0,0 +1,106 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试的目标服务都在本机, 需要允许访问127.0.0.1
+var loopbackACL, _ = ParseACL([]string{"allow:127.0.0.1"})
+
+func TestParseACL(t *testing.T) {
+	for _, spec := range []string{"10.0.0.0/8", "permit:10.0.0.0/8", "deny:", "deny:port:x", "deny:port:9-1", "allow:a b", "deny:http://x"} {
+		_, err := ParseACL([]string{spec})
+		assert.NotNil(t, err, spec)
+	}
+
+	acl, err := ParseACL([]string{"allow:10.1.0.0/16", "deny:port:25", "deny:*.Corp.Example.com", "allow:::1", "deny:port:6000-7000"})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(acl.rules))
+}
+
+func TestAllowDestination(t *testing.T) {
+	global, err := ParseACL([]string{"deny:port:25", "allow:10.1.0.0/16", "deny:corp.example.com"})
+	if err != nil {
+		log.Panic(err)
+	}
+	userACL, err := ParseACL([]string{"allow:corp.example.com", "deny:8.8.8.8"})
+	if err != nil {
+		log.Panic(err)
+	}
+	user := &User{Name: "alice", ACL: userACL}
+
+	cases := []struct {
+		user   *User
+		domain string
+		ip     string
+		port   int
+		allow  bool
+	}{
+		{nil, "", "8.8.8.8", 443, true},
+		{nil, "", "127.0.0.1", 80, false},
+		{nil, "", "169.254.169.254", 80, false},
+		{nil, "", "10.2.0.1", 80, false},
+		{nil, "", "192.168.1.1", 80, false},
+		{nil, "", "::1", 80, false},
+		{nil, "", "198.18.0.1", 80, false},
+		{nil, "", "224.0.0.251", 5353, false},
+		{nil, "", "255.255.255.255", 80, false},
+		{nil, "", "64:ff9b::a00:1", 80, false},
+		{nil, "", "::ffff:127.0.0.1", 80, false},
+		{nil, "", "fd00:ec2::254", 80, false},
+		// 域名解析到内网地址
+		{nil, "rebind.example.org", "127.0.0.1", 80, false},
+		// 全局规则
+		{nil, "", "10.1.2.3", 80, true},
+		{nil, "", "8.8.8.8", 25, false},
+		{nil, "git.corp.example.com", "8.8.4.4", 443, false},
+		// 用户规则优先
+		{user, "git.corp.example.com", "10.9.0.1", 443, true},
+		{user, "", "8.8.8.8", 443, false},
+		{user, "", "10.1.2.3", 80, true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allow, AllowDestination(c.user, global, c.domain, net.ParseIP(c.ip), c.port), "%s %s:%d", c.domain, c.ip, c.port)
+	}
+}
+
+func TestServerACL(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// 默认规则禁止访问本机
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg9"})
+
+	addr, err := net.ResolveTCPAddr("tcp", serverAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	auth, err := CreateAuth("random", "abcedfg9")
+	if err != nil {
+		log.Panic(err)
+	}
+	request, err := BuildRequest(CMD_CONNECT, echo.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, _, err = dialTunnel(context.Background(), addr, auth, "abcedfg9", request)
+	assert.Equal(t, byte(REP_NOT_ALLOWED), ReplyCode(err))
+}
@@ -0,0 +1,86 @@
+package socks5proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// 管理接口的状态输出
+type adminStatus struct {
+	Servers   []ServerStatus   `json:"servers"`
+	Outbounds []OutboundStatus `json:"outbounds,omitempty"`
+	Timeouts  TimeoutStatus    `json:"timeouts"`
+}
+
+// 管理接口:
+//
+//	GET  /status                          以json输出服务端的健康检查结果, 出站统计和超时次数
+//	POST /select?group=名称&outbound=名称   select出站组手动选择
+//	GET  /log/level                       输出日志级别
+//	POST /log/level?level=debug           修改日志级别
+//
+// 超时次数由每个ProxyClient统计, 单独使用ServeAdmin时为0
+func ServeAdmin(addr string, servers *ServerPool, outbounds *OutboundRouter) error {
+	return http.ListenAndServe(addr, adminHandler(servers, outbounds, nil))
+}
+
+func adminHandler(servers *ServerPool, outbounds *OutboundRouter, timeouts *timeoutCounters) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := adminStatus{Servers: servers.Status(), Timeouts: timeouts.status()}
+		if outbounds != nil {
+			status.Outbounds = outbounds.Status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+	})
+	mux.HandleFunc("/select", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if outbounds == nil {
+			http.Error(w, "no outbounds", http.StatusNotFound)
+			return
+		}
+		err := outbounds.Select(r.FormValue("group"), r.FormValue("outbound"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/log/level", handleLogLevel)
+	return mux
+}
+
+// 服务端管理接口的状态输出
+type serverAdminStatus struct {
+	Users    []UserStatus  `json:"users"`
+	Timeouts TimeoutStatus `json:"timeouts"`
+}
+
+// 服务端管理接口:
+//
+//	GET  /status                  以json输出每个用户的连接数和流量, 以及超时次数
+//	GET  /log/level               输出日志级别
+//	POST /log/level?level=debug   修改日志级别
+//
+// 超时次数由每个ProxyServer统计, 单独使用ServeServerAdmin时为0
+func ServeServerAdmin(addr string, users *UserDB) error {
+	return http.ListenAndServe(addr, serverAdminHandler(users, nil))
+}
+
+func serverAdminHandler(users *UserDB, timeouts *timeoutCounters) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(serverAdminStatus{Users: users.Status(), Timeouts: timeouts.status()})
+	})
+	mux.HandleFunc("/log/level", handleLogLevel)
+	return mux
+}
@@ -1,274 +1,414 @@
 package socks5proxy
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"log/slog"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
-type TcpClient struct {
-	conn   *net.TCPConn
-	server *net.TCPAddr
-}
-
-func handleProxyRequest_Proxy(localClient *net.TCPConn, dstServer *net.TCPConn, auth socks5Auth, recvHTTPProto string) {
+// logger带有连接ID, 和服务端的日志相同, ctx取消时结束转发. 结束时更新访问日志记录rec
+func handleProxyRequest_Proxy(ctx context.Context, localClient *net.TCPConn, dstServer *net.TCPConn, auth socks5Auth, timeouts Timeouts, logger *slog.Logger, rec *AccessRecord) {
 
 	defer dstServer.Close()
 	defer localClient.Close()
 
-	proxyId := rand.Uint32()
-	//ch := make(chan int)
-
 	// 和远程端建立安全信道
-	wg := new(sync.WaitGroup)
-	//wg.Add(2)
-	wg.Add(1)
+	up, down, err := relay(ctx, localClient, &cipherConn{Conn: dstServer, auth: auth}, timeouts, nil)
+	rec.done(up, down, err)
+	if err != nil {
+		logger.Warn("relay fail", "up", up, "down", down, "err", err)
+	} else {
+		logger.Info("done", "up", up, "down", down)
+	}
+}
 
-	// -----------> 本地的内容copy到远程端
-	go func() {
-		defer wg.Done()
-		_, err := SecureCopyNew_Client2Server(localClient, dstServer, auth.Encrypt)
-		if err != nil {
-			log.Printf("[ERRO] %010d, c->s exception, %v", proxyId, err)
-		}
-		log.Printf("[INFO] %010d,---------- wg.Done client2server is done", proxyId)
-	}()
+// 客户端可选配置
+type ClientOptions struct {
+	Upstream *UpstreamRouter // 直连的流量经过的上游代理, 为空时直连
+	Policy   string          // 多个服务端时的选择策略, 默认failover
+	Backoff  time.Duration   // 服务端失败后的退避时间, 默认10秒
 
-	// ------------> 远程得到的内容copy到源地址
-	go func() {
-		_, err := SecureCopy_Server2Client(dstServer, localClient, auth.Decrypt)
-		if err != nil {
-			log.Printf("[ERRO] %010d, s->c exception, %v", proxyId, err)
-		}
-		log.Printf("[INFO] %010d,---------- wg.Done server2client is done", proxyId)
-	}()
-	wg.Wait()
+	HealthCheck *HealthCheckOptions // 服务端健康检查, 为空时不检查
+	AdminAddr   string              // 管理接口侦听地址, 为空时不开启
+
+	Outbounds []string // 命名出站, "名称=定义", 见OutboundRouter.parseOutbound
+	Rules     []string // 路由规则, "域名后缀=出站名称", "*"匹配所有目标, 没有匹配时按GetProxyType的内置名单
+
+	Timeouts  *Timeouts  // 超时设置, 为空时使用DefaultTimeouts
+	AccessLog *AccessLog // 每个结束的代理连接一条记录, 为空时不记录
 
-	log.Printf("[INFO] %010d,--------------- Request_proxy proxy done --------------", proxyId)
+	// 0-RTT, 不等待服务端应答就回应应用成功, 请求头和第一段数据一起发送.
+	// 服务端连不上目标时应用只能看到连接被关闭, 而不是sock5的错误应答.
+	// 为false时只有分享链接要求fast_open的服务端使用0-RTT
+	FastOpen bool
 }
 
 func Client(listenAddrString string, serverAddrString string, encrytype string, passwd string, recvHTTPProto string) {
-	//所有客户服务端的流都加密,
-	auth, err := CreateAuth(encrytype, passwd)
+	ClientWithOptions(listenAddrString, serverAddrString, encrytype, passwd, recvHTTPProto, ClientOptions{})
+}
+
+func ClientWithOptions(listenAddrString string, serverAddrString string, encrytype string, passwd string, recvHTTPProto string, opts ClientOptions) {
+	client, err := NewProxyClient(ClientConfig{
+		ListenAddr:    listenAddrString,
+		ServerAddr:    serverAddrString,
+		EncryType:     encrytype,
+		Passwd:        passwd,
+		RecvHTTPProto: recvHTTPProto,
+		ClientOptions: opts,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Fatal(client.ListenAndServe())
+}
+
+// 嵌入使用的客户端配置
+type ClientConfig struct {
+	ListenAddr    string // ListenAndServe侦听的地址
+	ServerAddr    string // 服务端列表, 见ParseServerList
+	EncryType     string
+	Passwd        string
+	RecvHTTPProto string
+	ClientOptions
+
+	Logger *slog.Logger // 为空时使用slog.Default()
+	Dialer NetDialer    // direct出站直连(没有上游代理或者上游规则为直连)使用的拨号器, 为空时使用net.Dialer
+	Hooks  Hooks
+}
+
+// 可以嵌入和优雅关闭的客户端
+type ProxyClient struct {
+	listenAddr    string
+	outbounds     *OutboundRouter
+	recvHTTPProto string
+	timeouts      Timeouts
+	accessLog     *AccessLog
+	logger        *slog.Logger
+	hooks         Hooks
+
+	admin        *http.Server
+	adminOnce    sync.Once
+	conns        connTracker
+	timeoutStats timeoutCounters
+}
 
-	// 服务端
-	serverAddr, err := net.ResolveTCPAddr("tcp", serverAddrString)
+func NewProxyClient(cfg ClientConfig) (*ProxyClient, error) {
+	opts := cfg.ClientOptions
+	servers, outbounds, err := newClientRouter(cfg, false)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrString)
-	if err != nil {
-		log.Fatal(err)
+	timeouts := DefaultTimeouts
+	if opts.Timeouts != nil {
+		timeouts = *opts.Timeouts
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	c := &ProxyClient{
+		listenAddr:    cfg.ListenAddr,
+		outbounds:     outbounds,
+		recvHTTPProto: cfg.RecvHTTPProto,
+		timeouts:      timeouts,
+		accessLog:     opts.AccessLog,
+		logger:        logger,
+		hooks:         cfg.Hooks,
 	}
+	if len(opts.AdminAddr) > 0 {
+		c.admin = &http.Server{Addr: opts.AdminAddr, Handler: adminHandler(servers, outbounds, &c.timeoutStats), ErrorLog: errorLog(logger)}
+	}
+	return c, nil
+}
 
+// 这个客户端各种超时发生的次数
+func (c *ProxyClient) TimeoutStats() TimeoutStatus {
+	return c.timeoutStats.status()
+}
+
+// 侦听ClientConfig.ListenAddr并处理应用连接, 使用自己的listener时调用Serve
+func (c *ProxyClient) ListenAndServe() error {
 	// 本地侦听
-	listener, err := net.ListenTCP("tcp", listenAddr)
+	listener, err := net.Listen("tcp", c.listenAddr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	log.Printf("[INFO] local server port: %v, proto: %v", listenAddrString, recvHTTPProto)
+	c.logger.Info("listen", "addr", listener.Addr().String(), "proto", c.recvHTTPProto)
+	return c.Serve(listener)
+}
 
-	for {
-		localClient, err := listener.AcceptTCP()
-		if err != nil {
-			log.Printf("[ERRO] accept tcp connect fail, %v", err)
-		} else {
-			// 处理代理请求
-			go handleProxyRequest(localClient, serverAddr, auth, recvHTTPProto)
-		}
-	}
+// 处理listener上的应用连接, 直到listener出错或者Shutdown, Shutdown之后返回ErrServerClosed.
+// 第一次调用时启动管理接口
+func (c *ProxyClient) Serve(listener net.Listener) error {
+	c.adminOnce.Do(c.startAdmin)
+	return c.conns.serve(listener, c.logger, c.handleProxyRequest)
 }
 
-func handleProxyRequest_Direct(localClient *net.TCPConn, serverAddrString string, auth socks5Auth, recvHTTPProto string) {
-	serverAddr, err := net.ResolveTCPAddr("tcp", serverAddrString)
-	if err != nil {
-		log.Printf("[ERRO] resolve domain [%s] fail, %v", serverAddrString, err)
+func (c *ProxyClient) startAdmin() {
+	if c.admin == nil {
 		return
 	}
+	go func() {
+		c.logger.Info("admin listen", "addr", c.admin.Addr)
+		err := c.admin.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			c.logger.Error("admin server fail", "err", err)
+		}
+	}()
+}
 
-	// connet real server
-	dstServer, err := net.DialTCP("tcp", nil, serverAddr)
+// 停止接受新连接, 等待正在转发的连接结束, ctx结束时强制关闭剩下的连接并返回ctx.Err().
+// 关闭后停止服务端池和出站的后台任务
+func (c *ProxyClient) Shutdown(ctx context.Context) error {
+	if c.admin != nil {
+		c.admin.Close()
+	}
+	err := c.conns.shutdown(ctx, c.logger)
+	c.outbounds.Close()
+	return err
+}
+
+// 明文转发, 加密由出站连接负责
+// 经过服务端时请求头带上info.ID
+func (c *ProxyClient) handleProxyRequest_Direct(localClient net.Conn, serverAddrString string, outbound Outbound, info *ConnInfo, logger *slog.Logger, rec *AccessRecord) {
+	timeouts := c.timeouts
+	// connet real server, 出站可能经过服务端, 多等服务端连接目标的时间
+	ctx, cancel := timeouts.tunnelContext(c.conns.context())
+	dstServer, err := outbound.DialContext(withConnID(ctx, info.ID), "tcp", serverAddrString)
+	cancel()
 	if err != nil {
-		log.Printf("[ERRO] connect %s(%s) fail, %v", serverAddrString, serverAddr.String(), err)
+		countTimeout(&c.timeoutStats.dial, err)
+		logger.Warn("dial fail", "err", err)
+		rec.dialFail(err)
+		c.hooks.close(info, 0, 0, err)
+		// 服务端的应答码原样回应给应用
+		localClient.Write(BuildReply(ReplyCode(err), nil))
 		localClient.Close()
 		return
 	}
 	defer dstServer.Close()
 	defer localClient.Close()
 
-	// 和远程端建立安全信道
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-
-	// -----------> 本地的内容copy到远程端
-	go func() {
-		defer wg.Done()
-		SockCopy_C2S(localClient, dstServer)
-	}()
-
-	// ------------> 远程得到的内容copy到源地址
-	go func() {
-		//defer wg.Done()
-		SockCopy_S2C(dstServer, localClient)
-	}()
-	wg.Wait()
+	// 连接成功后才回应应用, 绑定地址为出站连接的本地地址, 经过服务端时为服务端应答的地址
+	_, err = localClient.Write(BuildReply(REP_SUCCEEDED, dstServer.LocalAddr()))
+	if err != nil {
+		rec.fail(CLOSE_ERROR, err)
+		c.hooks.close(info, 0, 0, err)
+		return
+	}
 
+	up, down, err := relay(c.conns.context(), localClient, dstServer, timeouts, &c.timeoutStats)
+	c.hooks.close(info, up, down, err)
+	rec.done(up, down, err)
+	if err != nil {
+		logger.Warn("relay fail", "up", up, "down", down, "err", err)
+	} else {
+		logger.Info("done", "up", up, "down", down)
+	}
 }
 
-func handleProxyRequest(localClient *net.TCPConn, serverAddr *net.TCPAddr, auth socks5Auth, recvHTTPProto string) {
-	var serverAddrString string
-
+func (c *ProxyClient) handleProxyRequest(localClient net.Conn) {
+	timeouts := c.timeouts
+	defer localClient.Close()
 	src := localClient
-	i := 0
-	size := 1024
-	buf := make([]byte, size)
-
-	var handshake_buf_step1 []byte
-	var handshake_buf_step2 []byte
-
-	for {
-		i++
-
-		// --------- read buf from client ---------
-		nr, err := src.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				return
-			}
-			log.Printf("[WARN] read src data pack fail, %v", err)
-			return
-		}
+	id := newConnID()
+	logger := c.logger.With("conn", id, "src", src.RemoteAddr().String())
 
-		if i == 1 {
-			//log.Printf("c->s, [%02d], len=%d, %v", i, nr, buf[:nr])
-			handshake_buf_step1 = make([]byte, nr)
-			copy(handshake_buf_step1, buf[0:nr])
-
-			// --------------- 认证协商 ----------------
-			var proto ProtocolVersion
-
-			// handshake
-			resp, err := proto.HandleHandshake(buf[0:nr])
-			if err != nil {
-				//log.Printf("[WARN] handshake fail, %v", err)
-				return
-			}
-
-			src.Write(resp)
-
-		} else if i == 2 {
-			//log.Printf("c->s, [%02d], len=%d, %v", i, nr, buf[:nr])
-			handshake_buf_step2 = make([]byte, nr)
-			copy(handshake_buf_step2, buf[0:nr])
-
-			var sock5Resolve Socks5Resolution
-			resp, err := sock5Resolve.LSTRequest(buf[:nr])
-			if err != nil {
-				log.Printf("[WARN] sock5 data package resolve fail, %v", err)
-				break
-			}
-			//log.Printf("[INFO] %s:%d", sock5Resolve.DSTDOMAIN, sock5Resolve.DSTPORT)
-			src.Write(resp)
-
-			// ---------------- read data handler -----------------
-			serverAddrString = fmt.Sprintf("%s:%d", sock5Resolve.DSTDOMAIN, sock5Resolve.DSTPORT)
-
-			break
-		} else {
-			log.Printf("[ERRO] --fuck-|c2s|--[%02d]->len=%d, %v", i, nr, buf[:nr])
+	// --------------- 认证协商 ----------------
+	clearDeadline := timeouts.handshakeDeadline(src)
+	proto, err := ReadGreeting(src)
+	if err != nil {
+		countTimeout(&c.timeoutStats.handshake, err)
+		if err != io.EOF {
+			logger.Warn("handshake fail", "err", err)
 		}
+		return
+	}
+	if !proto.acceptable() {
+		src.Write([]byte{SOCKS_VERSION, 0xFF})
+		return
+	}
+	_, err = src.Write([]byte{SOCKS_VERSION, METHOD_CODE})
+	if err != nil {
+		return
 	}
 
-	proxyType := GetProxyType(serverAddrString)
-
-	if proxyType == 0 {
-		log.Printf("[WARN] discard,  %s", serverAddrString)
+	// --------------- 代理请求 ----------------
+	request, err := ReadRequest(src)
+	clearDeadline()
+	if err != nil {
+		countTimeout(&c.timeoutStats.handshake, err)
+		logger.Warn("bad request", "err", err)
+		src.Write(BuildReply(ReplyCode(err), nil))
 		return
-	} else if proxyType == 2 {
-		// ----------------- 直连 --------------------
-		log.Printf("[INFO] direct, %v", serverAddrString)
-		handleProxyRequest_Direct(src, serverAddrString, auth, recvHTTPProto)
-	} else if proxyType == 1 {
-		// ----------------- 代理 --------------------
-		log.Printf("[INFO] proxy, %v", serverAddrString)
-
-		// connect sckpy server
-		dstServer, err := net.DialTCP("tcp", nil, serverAddr)
-		defer dstServer.Close()
-		if err != nil {
-			log.Printf("[ERRO] connect %s(%s) fail, %v", serverAddrString, serverAddr.String(), err)
-			localClient.Close()
-			return
-		}
+	}
+	// 私有命令只在客户端和服务端之间使用
+	if request.CMD != CMD_CONNECT {
+		logger.Warn("unsupported command", "cmd", request.CMD)
+		src.Write(BuildReply(REP_COMMAND_NOT_SUPPORTED, nil))
+		return
+	}
+	// 域名不在客户端解析, 由出站(服务端)解析
+	serverAddrString := request.Addr()
+	rec := newAccessRecord(src.RemoteAddr(), request)
+	rec.ID = id
+	defer c.accessLog.write(rec, logger)
+
+	// 按规则选择出站
+	outbound := c.outbounds.Resolve(serverAddrString)
+	rec.Route = outbound.Name()
+	logger = logger.With("dst", serverAddrString, "route", outbound.Name())
+	info := &ConnInfo{ID: id, Source: src.RemoteAddr(), Target: serverAddrString, Route: outbound.Name()}
+	if outbound.Name() == OUTBOUND_REJECT {
+		logger.Info("rejected by rule")
+		rec.fail(CLOSE_NOT_ALLOWED, nil)
+		c.hooks.close(info, 0, 0, errRejected)
+		src.Write(BuildReply(REP_NOT_ALLOWED, nil))
+		return
+	}
+	err = c.hooks.connect(info)
+	if err != nil {
+		logger.Warn("rejected by hook", "err", err)
+		rec.fail(CLOSE_NOT_ALLOWED, err)
+		c.hooks.close(info, 0, 0, err)
+		src.Write(BuildReply(REP_NOT_ALLOWED, nil))
+		return
+	}
+	logger.Info("connect")
+	c.handleProxyRequest_Direct(src, serverAddrString, outbound, info, logger, rec)
+}
 
-		// -------------------- 与服务器进行sock5握手 ------------------
-		//step 1
-		buf = handshake_buf_step1
-		//log.Printf("s1, %v", buf)
-		auth.Encrypt(buf)
-		//log.Printf("s1, enc, %v", buf)
-		_, err = dstServer.Write(buf)
-		if err != nil {
-			log.Printf("[ERRO] handshake step1 to server fail, %v", err)
-			localClient.Close()
-			return
-		}
-		nr, err := dstServer.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				log.Printf("[ERRO] close connect ,EOF")
-			}
-			localClient.Close()
-			return
-		}
-		if nr > 0 {
-			//log.Printf("c->s, [%02d], len=%d, %v", i, nr, buf[:nr])
-			auth.Decrypt(buf)
-			//log.Printf("c->s, [%02d], len=%d, %v", i, nr, buf[:nr])
-		}
+// 只检查客户端配置, 不启动健康检查和测速, 不连接服务端
+func CheckClientConfig(cfg ClientConfig) error {
+	_, outbounds, err := newClientRouter(cfg, true)
+	if err != nil {
+		return err
+	}
+	outbounds.Close()
+	return nil
+}
 
-		//step 2
-		buf = handshake_buf_step2
-		//log.Printf("s2, %v", buf)
-		auth.Encrypt(buf)
-		//log.Printf("s2, enc, %v", buf)
-		_, err = dstServer.Write(buf)
-		if err != nil {
-			log.Printf("[ERRO] handshake step2 to server fail, %v", err)
-			localClient.Close()
-			return
-		}
-		nr, err = dstServer.Read(buf)
-		if err != nil {
-			log.Printf("[ERRO] close connect, %v", err)
-			localClient.Close()
-			return
-		}
-		if nr > 0 {
-			//log.Printf("c->s, [%02d], len=%d, %v", i, nr, buf[:nr])
-			auth.Decrypt(buf)
-			//log.Printf("c->s, [%02d], len=%d, %v", i, nr, buf[:nr])
+// 按客户端配置创建服务端池和出站路由, ProxyClient和Dialer共用. check见CheckClientConfig
+func newClientRouter(cfg ClientConfig, check bool) (*ServerPool, *OutboundRouter, error) {
+	opts := cfg.ClientOptions
+	//所有客户服务端的流都加密, 服务端可以有多个
+	endpoints, err := ParseServerList(cfg.ServerAddr, cfg.EncryType, cfg.Passwd)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	newPool := newServerPool
+	if check {
+		newPool = parseServerPool
+	}
+	servers, err := newPool(endpoints, opts.Policy, opts.Backoff, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.HealthCheck != nil && check {
+		_, err = newProbe(opts.HealthCheck.Target)
+	} else if opts.HealthCheck != nil {
+		err = servers.StartHealthCheck(*opts.HealthCheck)
+	}
+	if err != nil {
+		servers.Close()
+		return nil, nil, err
+	}
+	outboundOpts := OutboundOptions{
+		Outbounds: opts.Outbounds,
+		Rules:     opts.Rules,
+		EncryType: cfg.EncryType,
+		Passwd:    cfg.Passwd,
+		Policy:    opts.Policy,
+		Backoff:   opts.Backoff,
+		FastOpen:  opts.FastOpen,
+		Dialer:    cfg.Dialer,
+		Logger:    logger,
+	}
+	if opts.HealthCheck != nil {
+		if probe, err := newProbe(opts.HealthCheck.Target); err == nil {
+			outboundOpts.TestTarget = probe.addr
 		}
-		handleProxyRequest_Proxy(src, dstServer, auth, recvHTTPProto)
+		outboundOpts.TestInterval = opts.HealthCheck.Interval
+	}
+	outbounds, err := newOutboundRouter(servers, opts.Upstream, outboundOpts, check)
+	if err != nil {
+		return nil, nil, err
+	}
+	return servers, outbounds, nil
+}
+
+// 连接sckpy服务端, 发送加密的请求头, 返回已建立的加密信道和服务端应答的绑定地址
+// ctx的超时包括等待服务端连接目标的时间
+func dialTunnel(ctx context.Context, serverAddr *net.TCPAddr, auth socks5Auth, passwd string, request []byte) (*net.TCPConn, net.Addr, error) {
+	header, err := buildHeader(auth, passwd, request, connIDFrom(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	dstServer, err := connectServer(ctx, serverAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return handshakeTunnel(ctx, dstServer, auth, header)
+}
+
+// 建立到服务端的TCP连接
+func connectServer(ctx context.Context, serverAddr *net.TCPAddr) (*net.TCPConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", serverAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// 在已建立的连接上发送请求头并读取应答, 失败时关闭连接
+func handshakeTunnel(ctx context.Context, dstServer *net.TCPConn, auth socks5Auth, header []byte) (*net.TCPConn, net.Addr, error) {
+	setHandshakeDeadline(ctx, dstServer)
+
+	_, err := dstServer.Write(header)
+	if err != nil {
+		dstServer.Close()
+		return nil, nil, fmt.Errorf("handshake to server fail, %w", err)
+	}
+	// 应答之后可能紧跟着数据, 只读取应答本身
+	resp, err := ReadReply(dstServer, auth.Decrypt)
+	if err != nil {
+		dstServer.Close()
+		return nil, nil, fmt.Errorf("handshake read fail, %w", err)
+	}
+	if resp[1] != REP_SUCCEEDED {
+		dstServer.Close()
+		return nil, nil, &ReplyError{Rep: resp[1]}
+	}
+	bind, err := ParseReplyAddr(resp)
+	if err != nil {
+		dstServer.Close()
+		return nil, nil, fmt.Errorf("handshake reply fail, %w", err)
 	}
+	dstServer.SetDeadline(time.Time{})
+	return dstServer, bind, nil
 }
 
 func GetProxyType(domain string) int {
 	// 1 代理 2 不代理  0 丢弃
 	if len(domain) == 0 {
-		log.Printf("[INFO] domain is nil")
+		slog.Debug("domain is empty")
 		return 0
 	}
 	if domain[0:1] == ":" {
-		log.Printf("[INFO] unkown domain, %v", domain)
+		slog.Debug("unknown domain", "domain", domain)
 		return 2
 	}
 
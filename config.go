@@ -0,0 +1,343 @@
+package socks5proxy
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 服务端配置文件, YAML或者JSON. 每一项对应flag标签中的命令行参数, 命令行指定的参数覆盖文件中的值,
+// 两者都没有时使用参数的默认值. 示例见docs/server.yaml
+type ServerFileConfig struct {
+	Listen       string          `yaml:"listen" flag:"local"`
+	Type         string          `yaml:"type" flag:"type"`
+	Passwd       string          `yaml:"passwd" flag:"passwd"`
+	Users        []string        `yaml:"users"` // 内联用户, 每项和用户文件的一行相同, 不能和users_file同时使用
+	UsersFile    string          `yaml:"users_file" flag:"users"`
+	ReversePorts string          `yaml:"reverse_ports" flag:"reverse-ports"`
+	ReverseBind  string          `yaml:"reverse_bind" flag:"reverse-bind"`
+	Admin        string          `yaml:"admin" flag:"admin"`
+	Limits       LimitConfig     `yaml:"limits"`
+	ACL          []string        `yaml:"acl" flag:"acl"`
+	Upstream     []string        `yaml:"upstream" flag:"upstream"`
+	RemoteDNS    bool            `yaml:"upstream_remote_dns" flag:"upstream-remote-dns"` // 上游代理解析域名, acl只按域名和端口检查
+	DNS          string          `yaml:"dns" flag:"dns"`
+	Timeouts     TimeoutConfig   `yaml:"timeouts"`
+	Log          LogConfig       `yaml:"log"`
+	AccessLog    AccessLogConfig `yaml:"access_log"`
+	Share        ShareConfig     `yaml:"share"`
+}
+
+// 客户端配置文件, 示例见docs/client.yaml
+type ClientFileConfig struct {
+	Listen      string            `yaml:"listen" flag:"port"`
+	Recv        string            `yaml:"recv" flag:"recv"`
+	Servers     []string          `yaml:"servers" flag:"server"` // 每项为host:port, type:passwd@host:port或者分享链接
+	Type        string            `yaml:"type" flag:"type"`
+	Passwd      string            `yaml:"passwd" flag:"passwd"`
+	Policy      string            `yaml:"policy" flag:"policy"`
+	Backoff     time.Duration     `yaml:"backoff" flag:"backoff"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Admin       string            `yaml:"admin" flag:"admin"`
+	FastOpen    bool              `yaml:"fast_open" flag:"fast-open"`
+	Outbounds   []string          `yaml:"outbounds" flag:"outbound"`
+	Rules       []string          `yaml:"rules" flag:"rule"`
+	Upstream    []string          `yaml:"upstream" flag:"upstream"`
+	Forwards    []string          `yaml:"forwards" flag:"L"`
+	Reverses    []string          `yaml:"reverses" flag:"R"`
+	DNS         string            `yaml:"dns" flag:"dns"`
+	Timeouts    TimeoutConfig     `yaml:"timeouts"`
+	Log         LogConfig         `yaml:"log"`
+	AccessLog   AccessLogConfig   `yaml:"access_log"`
+}
+
+type LimitConfig struct {
+	Up        string `yaml:"up" flag:"limit-up"`     // 所有用户共用的上传速度, 例如10M
+	Down      string `yaml:"down" flag:"limit-down"` // 所有用户共用的下载速度
+	QuotaFile string `yaml:"quota_file" flag:"quota-file"`
+}
+
+type HealthCheckConfig struct {
+	Target   string        `yaml:"target" flag:"probe"`
+	Interval time.Duration `yaml:"interval" flag:"probe-interval"`
+}
+
+type TimeoutConfig struct {
+	Handshake time.Duration `yaml:"handshake" flag:"handshake-timeout"`
+	Dial      time.Duration `yaml:"dial" flag:"dial-timeout"`
+	Idle      time.Duration `yaml:"idle" flag:"idle-timeout"`
+	Lifetime  time.Duration `yaml:"lifetime" flag:"max-lifetime"`
+	Shutdown  time.Duration `yaml:"shutdown" flag:"shutdown-timeout"`
+}
+
+func (t TimeoutConfig) Timeouts() *Timeouts {
+	return &Timeouts{Handshake: t.Handshake, Dial: t.Dial, Idle: t.Idle, Lifetime: t.Lifetime}
+}
+
+// server link输出的分享链接
+type ShareConfig struct {
+	Addr     string `yaml:"addr" flag:"share-addr"`           // 客户端连接服务端使用的地址, 为空时使用listen
+	FastOpen bool   `yaml:"fast_open" flag:"share-fast-open"` // 链接要求客户端使用0-RTT
+}
+
+type LogConfig struct {
+	File   string `yaml:"file" flag:"log-file"`     // 日志文件, 为空时输出到stderr
+	Level  string `yaml:"level" flag:"log-level"`   // debug, info, warn, error
+	Format string `yaml:"format" flag:"log-format"` // text或json
+}
+
+type AccessLogConfig struct {
+	File    string `yaml:"file" flag:"access-log"`              // 访问日志文件, "-"为标准输出, 为空时不记录
+	Format  string `yaml:"format" flag:"access-log-format"`     // csv或json
+	MaxSize string `yaml:"max_size" flag:"access-log-max-size"` // 超过后轮转, 例如100M, 0为不轮转
+	Backups int    `yaml:"backups" flag:"access-log-backups"`   // 保留的旧文件个数
+}
+
+// 打开访问日志, 没有文件时返回nil
+func (c AccessLogConfig) Open() (*AccessLog, error) {
+	if len(c.File) == 0 {
+		return nil, nil
+	}
+	var maxSize int64
+	if len(c.MaxSize) > 0 {
+		var err error
+		maxSize, err = ParseSize(c.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewAccessLog(c.File, c.Format, maxSize, c.Backups)
+}
+
+// 按级别和格式创建写入w的handler, 同时设置LogLevel
+func (c LogConfig) Handler(w io.Writer) (slog.Handler, error) {
+	level, err := ParseLogLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewLogHandler(w, c.Format)
+	if err != nil {
+		return nil, err
+	}
+	LogLevel.Set(level)
+	return h, nil
+}
+
+// 加载配置文件并合并命令行参数, cfg为*ServerFileConfig或*ClientFileConfig, path为空时只使用命令行参数.
+// 文件中有未知的项时报错
+func LoadConfig(path string, cfg interface{}, fs *flag.FlagSet) error {
+	err := applyFlags(reflect.ValueOf(cfg).Elem(), fs, nil)
+	if err != nil {
+		return err
+	}
+	if len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// JSON也按YAML解析, 时间可以写成"10s"
+		err = yaml.UnmarshalStrict(data, cfg)
+		if err != nil {
+			return fmt.Errorf("%s, %v", path, err)
+		}
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return applyFlags(reflect.ValueOf(cfg).Elem(), fs, set)
+}
+
+// 按flag标签把命令行参数的值写入配置, set为空时写入所有参数(默认值), 否则只写入命令行指定的参数.
+// 参数值需要实现flag.Getter, 字符串写入列表时按","分隔
+func applyFlags(v reflect.Value, fs *flag.FlagSet, set map[string]bool) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			err := applyFlags(field, fs, set)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		name := v.Type().Field(i).Tag.Get("flag")
+		f := fs.Lookup(name)
+		if len(name) == 0 || f == nil || (set != nil && !set[name]) {
+			continue
+		}
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return fmt.Errorf("参数 -%s 不支持配置文件", name)
+		}
+		value := reflect.ValueOf(getter.Get())
+		if field.Kind() == reflect.Slice && value.Kind() == reflect.String {
+			var items []string
+			for _, item := range strings.Split(value.String(), ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					items = append(items, item)
+				}
+			}
+			value = reflect.ValueOf(items)
+		}
+		if !value.Type().AssignableTo(field.Type()) {
+			return fmt.Errorf("参数 -%s 的类型和配置不一致", name)
+		}
+		field.Set(value)
+	}
+	return nil
+}
+
+// 以YAML输出合并后的配置
+func FormatConfig(cfg interface{}) (string, error) {
+	data, err := yaml.Marshal(cfg)
+	return string(data), err
+}
+
+// 输出配置时代替密码
+const redactedSecret = "******"
+
+// 隐藏密码后的配置, check子命令输出时使用
+func (c ServerFileConfig) Redacted() ServerFileConfig {
+	c.Passwd = redactSecret(c.Passwd)
+	c.Users = redactEach(c.Users, redactUserLine)
+	c.Upstream = redactEach(c.Upstream, redactUpstreamRule)
+	return c
+}
+
+// 隐藏密码后的配置, 包括服务端列表, 分享链接, 出站和上游代理中的密码
+func (c ClientFileConfig) Redacted() ClientFileConfig {
+	c.Passwd = redactSecret(c.Passwd)
+	c.Servers = redactEach(c.Servers, redactServerList)
+	c.Outbounds = redactEach(c.Outbounds, redactOutbound)
+	c.Upstream = redactEach(c.Upstream, redactUpstreamRule)
+	return c
+}
+
+func redactSecret(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	return redactedSecret
+}
+
+// 返回新的slice, 不修改原来的配置
+func redactEach(items []string, redact func(string) string) []string {
+	if items == nil {
+		return nil
+	}
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[i] = redact(item)
+	}
+	return out
+}
+
+// "用户名 加密方法 密码 ..."
+func redactUserLine(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return line
+	}
+	fields[2] = redactedSecret
+	return strings.Join(fields, " ")
+}
+
+// 见ParseServerList
+func redactServerList(spec string) string {
+	items := strings.Split(spec, ",")
+	for i, item := range items {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, SHARE_SCHEME+"://") {
+			l, err := ParseShareLink(item)
+			if err != nil {
+				items[i] = redactedSecret
+			} else {
+				items[i] = SHARE_SCHEME + "://" + redactedSecret + "@" + l.Addr
+			}
+			continue
+		}
+		j := strings.LastIndex(item, "@")
+		if j < 0 {
+			continue
+		}
+		encrytype := item[:j]
+		if k := strings.Index(encrytype, ":"); k >= 0 {
+			encrytype = encrytype[:k]
+		}
+		items[i] = encrytype + ":" + redactedSecret + item[j:]
+	}
+	return strings.Join(items, ",")
+}
+
+// "名称=定义", 见OutboundRouter.parseOutbound
+func redactOutbound(spec string) string {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return spec
+	}
+	name, def := spec[:i+1], spec[i+1:]
+	switch {
+	case strings.HasPrefix(def, "server:"):
+		return name + "server:" + redactServerList(def[len("server:"):])
+	case strings.HasPrefix(def, "upstream:"):
+		return name + "upstream:" + redactUpstream(def[len("upstream:"):])
+	}
+	return spec
+}
+
+// "域名后缀=代理链", 见ParseUpstreamRules
+func redactUpstreamRule(spec string) string {
+	i := strings.Index(spec, "=")
+	return spec[:i+1] + redactUpstream(spec[i+1:])
+}
+
+// 代理链中URL的密码, 见ParseUpstream
+func redactUpstream(chain string) string {
+	hops := strings.Split(chain, ",")
+	for i, hop := range hops {
+		u, err := url.Parse(strings.TrimSpace(hop))
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, ok := u.User.Password(); !ok {
+			continue
+		}
+		// url.UserPassword会转义"*", 手动拼接
+		user := url.User(u.User.Username()).String()
+		u.User = nil
+		s := u.String()
+		j := strings.Index(s, "://") + 3
+		hops[i] = s[:j] + user + ":" + redactedSecret + "@" + s[j:]
+	}
+	return strings.Join(hops, ",")
+}
+
+// 使用指定DNS服务器(host:port, 端口默认53)的解析器, addr为空时返回nil, 即系统设置
+func NewResolver(addr string) (*net.Resolver, error) {
+	if len(addr) == 0 {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("DNS地址错误, %s", addr)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
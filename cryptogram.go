@@ -1,15 +1,11 @@
 package socks5proxy
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"io"
-	"log"
-)
-
-const (
-	RANDOM_A = 13
-	RANDOM_B = 7
-	RANDOM_M = 256
+	"net"
 )
 
 type socks5Auth interface {
@@ -72,22 +68,39 @@ func (s *DefaultAuth) DecodeRead(c io.ReadWriter, b []byte) (int, error) {
 	return n, err
 }
 
+// 由密码派生的字节流, 依次为SHA-256(passwd|计数器), 加密表只和密码内容有关
+type passwdStream struct {
+	passwd  string
+	counter uint32
+	buf     []byte
+}
+
+func (s *passwdStream) next() byte {
+	if len(s.buf) == 0 {
+		h := sha256.New()
+		h.Write([]byte(s.passwd))
+		binary.Write(h, binary.BigEndian, s.counter)
+		s.counter++
+		s.buf = h.Sum(nil)
+	}
+	b := s.buf[0]
+	s.buf = s.buf[1:]
+	return b
+}
+
 func CreateSimpleCipher(passwd string) (*DefaultAuth, error) {
 	var s *DefaultAuth
-	// 采用最简单的凯撒位移法
-	sumint := 0
+	// 采用最简单的凯撒位移法, 位移由密码派生
 	if len(passwd) == 0 {
 		return nil, errors.New("密码不能为空")
 	}
-	for v := range passwd {
-		sumint += int(v)
-	}
-	sumint = sumint % 256
+	stream := &passwdStream{passwd: passwd}
+	shift := int(stream.next())
 	var encodeString [256]byte
 	var decodeString [256]byte
 	for i := 0; i < 256; i++ {
-		encodeString[i] = byte((i + sumint) % 256)
-		decodeString[i] = byte((i - sumint + 256) % 256)
+		encodeString[i] = byte((i + shift) % 256)
+		decodeString[i] = byte((i - shift + 256) % 256)
 	}
 	s = &DefaultAuth{
 		Encode: &encodeString,
@@ -98,21 +111,22 @@ func CreateSimpleCipher(passwd string) (*DefaultAuth, error) {
 
 func CreateRandomCipher(passwd string) (*DefaultAuth, error) {
 	var s *DefaultAuth
-	// 采用随机编码表进行加密
-	sumint := 0
+	// 采用随机编码表进行加密, 用密码派生的字节流打乱(Fisher-Yates)
 	if len(passwd) == 0 {
 		return nil, errors.New("密码不能为空")
 	}
-	for v := range passwd {
-		sumint += int(v)
-	}
+	stream := &passwdStream{passwd: passwd}
 	var encodeString [256]byte
 	var decodeString [256]byte
-	// 创建随机数 (a*x + b) mod m
-	for i := 0; i < 256; i++ {
-		encodeString[i] = byte((RANDOM_A*sumint + RANDOM_B) % RANDOM_M)
-		decodeString[(RANDOM_A*sumint+RANDOM_B)%RANDOM_M] = byte(i)
-		sumint = (RANDOM_A*sumint + RANDOM_B) % RANDOM_M
+	for i := range encodeString {
+		encodeString[i] = byte(i)
+	}
+	for i := 255; i > 0; i-- {
+		j := (int(stream.next())<<8 | int(stream.next())) % (i + 1)
+		encodeString[i], encodeString[j] = encodeString[j], encodeString[i]
+	}
+	for i, v := range encodeString {
+		decodeString[v] = byte(i)
 	}
 	s = &DefaultAuth{
 		Encode: &encodeString,
@@ -144,244 +158,87 @@ func CreateAuth(encrytype string, passwd string) (socks5Auth, error) {
 	return s, nil
 }
 
-// 加密io复制，可接收加密函数作为参数
-func SecureCopy(src io.ReadWriteCloser, dst io.ReadWriteCloser, secure func(b []byte) error) (written int64, err error) {
-	size := 1024
-	buf := make([]byte, size)
-	for {
-		// --------- read buf from client ---------
-		nr, er := src.Read(buf)
-		// ------------ encrypt data
-		secure(buf)
-		if nr > 0 {
-			// -------------- write buf to server -----------
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-	}
+// 加密信道上的连接, 写入时加密, 读取时解密.
+// 数据按帧发送, 帧格式和UDP数据报相同(见writeDatagram), 长度为0的帧表示对端关闭了发送方向,
+// 没有收到关闭帧就断开的连接读取时返回io.ErrUnexpectedEOF
+type cipherConn struct {
+	net.Conn
+	auth socks5Auth
 
-	return written, nil
+	remain int  // 当前帧未读取的长度
+	eof    bool // 已经收到关闭帧
 }
 
-// 加密io复制，可接收加密函数作为参数
-func SecureCopy_Client2Server(src io.ReadWriteCloser, dst io.ReadWriteCloser, secure func(b []byte) error) (written int64, err error) {
-	i := 0
-	size := 1024
-	buf := make([]byte, size)
-	for {
-		i++
+// 每帧最多的数据长度
+const cipherFrameSize = 16 * 1024
 
-		// --------- read buf from client ---------
-		nr, er := src.Read(buf)
-		if i == 1 {
-			//log.Printf("---|c2s|--[%02d]->len=%d, %v", i, nr, buf[:nr])
-		} else if i == 2 {
-			//log.Printf("---|c2s|--[%02d]->len=%d, %v", i, nr, buf[:nr])
-			var sock5Resolve Socks5Resolution
-			_, err = sock5Resolve.LSTRequest(buf[:nr])
-			if err != nil {
-				log.Printf("[WARN] data package resolve fail, %v", err)
-			}
-			log.Printf("[INFO] %s:%d", sock5Resolve.DSTDOMAIN, sock5Resolve.DSTPORT)
-			//} else if i == 3 {
-			//log.Printf("---|c2s|--[%02d]->len=%d, %v", i, nr, buf[:nr])
+func (c *cipherConn) Read(b []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+	if c.remain == 0 {
+		var head [2]byte
+		_, err := io.ReadFull(c.Conn, head[:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-
-		// ------------ encrypt data
-		secure(buf)
-		if nr > 0 {
-			// -------------- write buf to server -----------
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
+		if err != nil {
+			return 0, err
 		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
+		c.auth.Decrypt(head[:])
+		c.remain = int(binary.BigEndian.Uint16(head[:]))
+		if c.remain == 0 {
+			c.eof = true
+			return 0, io.EOF
 		}
 	}
-	return written, err
-}
-
-// 加密io复制，可接收加密函数作为参数
-func SecureCopy_Server2Client(src io.ReadWriteCloser, dst io.ReadWriteCloser, secure func(b []byte) error) (written int64, err error) {
-	// --------------------------- sock5 -----------------------
-	i := 0
-	size := 1024
-	buf := make([]byte, size)
-	for {
-		i++
-
-		// --------- read buf from client ---------
-		nr, er := src.Read(buf)
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-		// ------------ encrypt data
-		secure(buf)
-		if nr > 0 {
-			// -------------- write buf to server -----------
-			nw, ew := dst.Write(buf[0:nr])
-			if ew != nil {
-				err = ew
-				//log.Printf("[ERRO] s->c, write to client fail, %v", err)
-				break
-			}
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				//log.Printf("[ERRO] s->c, write to client fail, %v", err)
-				break
-			}
-		}
+	if len(b) > c.remain {
+		b = b[:c.remain]
 	}
-
-	//log.Printf("[INFO] ------------ s to c, proxy done")
-
-	return written, err
-}
-
-func SockCopy_C2S(src io.ReadWriteCloser, dst io.ReadWriteCloser) (written int64, err error) {
-	i := 0
-	size := 1024
-	buf := make([]byte, size)
-	for {
-		i++
-
-		// --------- read buf from client ---------
-		nr, er := src.Read(buf)
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-		if nr > 0 {
-			//log.Printf("c->s, [%03d], len=%d, %v", i, nr, buf[0:nr])
-			// -------------- write buf to server -----------
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.auth.Decrypt(b[:n])
+		c.remain -= n
 	}
-
-	return written, err
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
-func SockCopy_S2C(src io.ReadWriteCloser, dst io.ReadWriteCloser) (written int64, err error) {
-	i := 0
-	size := 1024
-	buf := make([]byte, size)
-	for {
-		i++
-
-		// --------- read buf from client ---------
-		nr, er := src.Read(buf)
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-		if nr > 0 {
-			//log.Printf("s->c, [%03d], len=%d, %v", i, nr, buf[0:nr])
-			// -------------- write buf to server -----------
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
+func (c *cipherConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
 	}
-
-	return written, err
+	bp := getRelayBuffer()
+	defer putRelayBuffer(bp)
+	_, err := c.Conn.Write(c.appendFrames((*bp)[:0], b))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 
-func SecureCopyNew_Client2Server(src io.ReadWriteCloser, dst io.ReadWriteCloser, secure func(b []byte) error) (written int64, err error) {
-	i := 0
-	size := 1024
-	buf := make([]byte, size)
-	for {
-		i++
-
-		// --------- read buf from client ---------
-		nr, er := src.Read(buf)
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-
-			//log.Printf("[ERROR] EOF, c 2 s,  %v", err)
-			break
-		}
-		// ------------ encrypt data
-		secure(buf)
-		if nr > 0 {
-			// -------------- write buf to server -----------
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
+// 发送关闭帧, 对端读到EOF, 另一个方向继续转发
+func (c *cipherConn) CloseWrite() error {
+	frame := []byte{0, 0}
+	c.auth.Encrypt(frame)
+	_, err := c.Conn.Write(frame)
+	return err
+}
 
-				break
-			}
+// 把数据分成加密的帧追加到dst
+func (c *cipherConn) appendFrames(dst []byte, b []byte) []byte {
+	for len(b) > 0 {
+		n := len(b)
+		if n > cipherFrameSize {
+			n = cipherFrameSize
 		}
+		start := len(dst)
+		dst = append(dst, byte(n>>8), byte(n))
+		dst = append(dst, b[:n]...)
+		c.auth.Encrypt(dst[start:])
+		b = b[n:]
 	}
-
-	//log.Printf("----------------- proxy done ---------------")
-	return written, err
+	return dst
 }
@@ -49,3 +49,17 @@ func TestRandomCipher(t *testing.T) {
 	}
 	assert.Equal(t, b, c)
 }
+
+func TestCipherTableFromPasswd(t *testing.T) {
+	// 长度相同的密码得到不同的加密表, 相同的密码得到相同的加密表
+	for _, create := range []func(string) (*DefaultAuth, error){CreateSimpleCipher, CreateRandomCipher} {
+		a, _ := create("s3cret01")
+		b, _ := create("hunter22")
+		c, _ := create("s3cret01")
+		assert.NotEqual(t, *a.Encode, *b.Encode)
+		assert.Equal(t, *a.Encode, *c.Encode)
+		for i, v := range a.Encode {
+			assert.Equal(t, byte(i), a.Decode[v])
+		}
+	}
+}
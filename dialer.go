@@ -0,0 +1,87 @@
+package socks5proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// 不经过本地sock5侦听, 在程序中直接通过sckpy服务端连接目标.
+// 按ClientConfig的出站和路由规则选择直连, 服务端或者拒绝, 和客户端的行为相同.
+// 实现了golang.org/x/net/proxy的Dialer和ContextDialer, 可以用于http.Transport.DialContext,
+// grpc.WithContextDialer或者数据库驱动:
+//
+//	d, err := socks5proxy.NewDialer(socks5proxy.ClientConfig{ServerAddr: "1.2.3.4:18888", EncryType: "random", Passwd: "passwd"})
+//	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+//
+// ClientConfig的ListenAddr, RecvHTTPProto和Logger不使用, Hooks只调用OnConnect;
+// 连接交给调用方管理, 不检查空闲时间和最长时间
+type Dialer struct {
+	outbounds    *OutboundRouter
+	timeouts     Timeouts
+	hooks        Hooks
+	timeoutStats timeoutCounters
+}
+
+func NewDialer(cfg ClientConfig) (*Dialer, error) {
+	_, outbounds, err := newClientRouter(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := DefaultTimeouts
+	if cfg.Timeouts != nil {
+		timeouts = *cfg.Timeouts
+	}
+	return &Dialer{outbounds: outbounds, timeouts: timeouts, hooks: cfg.Hooks}, nil
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// 只支持tcp. ctx没有期限时使用Timeouts.Dial, 包括等待服务端连接目标的时间.
+// 被路由规则或者OnConnect拒绝时返回*ReplyError{REP_NOT_ALLOWED}
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("不支持的网络类型, %s", network)
+	}
+	if _, ok := ctx.Deadline(); !ok && d.timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeouts.Dial)
+		defer cancel()
+	}
+
+	outbound := d.outbounds.Resolve(addr)
+	if outbound.Name() == OUTBOUND_REJECT {
+		return nil, &ReplyError{Rep: REP_NOT_ALLOWED}
+	}
+	// 和客户端一样生成连接ID, 经过服务端时放在请求头中, 两端的日志和Hooks使用相同的ID
+	id := newConnID()
+	info := &ConnInfo{ID: id, Target: addr, Route: outbound.Name()}
+	if err := d.hooks.connect(info); err != nil {
+		return nil, &ReplyError{Rep: REP_NOT_ALLOWED}
+	}
+	conn, err := outbound.DialContext(withConnID(ctx, id), "tcp", addr)
+	if err != nil {
+		countTimeout(&d.timeoutStats.dial, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// 停止服务端池和出站的后台任务, 已经建立的连接不受影响
+func (d *Dialer) Close() {
+	d.outbounds.Close()
+}
+
+// 每个出站的连接数和流量
+func (d *Dialer) Status() []OutboundStatus {
+	return d.outbounds.Status()
+}
+
+// 连接超时的次数, Dialer不检查空闲时间和最长时间, 只有Dial
+func (d *Dialer) TimeoutStats() TimeoutStatus {
+	return d.timeoutStats.status()
+}
@@ -0,0 +1,182 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// golang.org/x/net/proxy的Dialer和ContextDialer
+var (
+	_ interface {
+		Dial(network, addr string) (net.Conn, error)
+	} = (*Dialer)(nil)
+	_ interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	} = (*Dialer)(nil)
+)
+
+func TestDialer(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer web.Close()
+
+	// 两端的OnConnect收到相同的连接ID
+	var mu sync.Mutex
+	var clientIDs, serverIDs []ConnID
+	server, err := NewProxyServer(ServerConfig{
+		EncryType:     "random",
+		Passwd:        "abcedfg16",
+		ServerOptions: ServerOptions{ACL: loopbackACL},
+		Hooks: Hooks{OnConnect: func(info *ConnInfo) error {
+			mu.Lock()
+			serverIDs = append(serverIDs, info.ID)
+			mu.Unlock()
+			return nil
+		}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+
+	d, err := NewDialer(ClientConfig{
+		ServerAddr: l.Addr().String(),
+		EncryType:  "random",
+		Passwd:     "abcedfg16",
+		ClientOptions: ClientOptions{
+			Rules: []string{"127.0.0.1=" + OUTBOUND_PROXY, "blocked.example=" + OUTBOUND_REJECT},
+		},
+		Hooks: Hooks{OnConnect: func(info *ConnInfo) error {
+			mu.Lock()
+			clientIDs = append(clientIDs, info.ID)
+			mu.Unlock()
+			return nil
+		}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 作为http.Transport的拨号器, 经过服务端访问
+	transport := &http.Transport{DialContext: d.DialContext}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get(web.URL)
+	if err != nil {
+		log.Panic(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(body))
+	mu.Lock()
+	assert.Len(t, clientIDs, 1)
+	assert.NotEqual(t, ConnID(0), clientIDs[0])
+	assert.Equal(t, clientIDs, serverIDs)
+	mu.Unlock()
+	for _, s := range d.Status() {
+		if s.Name == OUTBOUND_PROXY {
+			assert.Equal(t, int64(1), s.Connections)
+		}
+	}
+
+	_, err = d.Dial("tcp", "blocked.example:80")
+	assert.Equal(t, &ReplyError{Rep: REP_NOT_ALLOWED}, err)
+	_, err = d.Dial("udp", web.Listener.Addr().String())
+	assert.NotNil(t, err)
+}
+
+func TestCheckClientConfig(t *testing.T) {
+	// 服务端, 健康检查和测速都指向同一个端口, 检查配置时不应该有连接
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	cfg := ClientConfig{
+		ServerAddr: l.Addr().String() + "," + l.Addr().String(),
+		EncryType:  "random",
+		Passwd:     "abcedfg16",
+		ClientOptions: ClientOptions{
+			HealthCheck: &HealthCheckOptions{Target: l.Addr().String(), Interval: 10 * time.Millisecond},
+			Outbounds:   []string{"hk=server:random:abcedfg16@" + l.Addr().String(), "auto=url-test:hk,direct"},
+			Rules:       []string{"*=auto"},
+		},
+	}
+	assert.Nil(t, CheckClientConfig(cfg))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+
+	cfg.HealthCheck.Target = "bad target"
+	assert.NotNil(t, CheckClientConfig(cfg))
+	cfg.HealthCheck = nil
+	cfg.Rules = []string{"*=missing"}
+	assert.NotNil(t, CheckClientConfig(cfg))
+}
+
+func TestDialerDeadline(t *testing.T) {
+	// 接受连接后不应答的服务端
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d, err := NewDialer(ClientConfig{
+		ServerAddr: silent.Addr().String() + "," + silent.Addr().String() + "," + silent.Addr().String(),
+		EncryType:  "random",
+		Passwd:     "abcedfg16",
+		ClientOptions: ClientOptions{
+			Rules:    []string{"*=" + OUTBOUND_PROXY},
+			Timeouts: &Timeouts{Dial: 300 * time.Millisecond},
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer d.Close()
+
+	// 依次尝试所有服务端, 一共不超过Timeouts.Dial
+	start := time.Now()
+	_, err = d.Dial("tcp", "example.com:80")
+	assert.NotNil(t, err)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed < 450*time.Millisecond, elapsed)
+	assert.Equal(t, int64(1), d.TimeoutStats().Dial)
+}
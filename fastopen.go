@@ -0,0 +1,110 @@
+package socks5proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 0-RTT时等待应用第一段数据的时间, 超时后单独发送请求头, 用于服务端先发送数据的协议(SMTP, SSH等)
+const fastOpenWait = 100 * time.Millisecond
+
+// 0-RTT加密信道, 不等待服务端应答就返回给应用, 第一次写入时请求头和数据一次发送,
+// 第一次读取时才读取服务端的应答. 服务端连不上目标时应用已经收到成功应答, 只能关闭连接
+type fastOpenConn struct {
+	*poolConn
+	header []byte // 未发送的请求头, 已加密
+
+	mu   sync.Mutex
+	sent chan struct{} // 请求头发送后关闭
+
+	replyOnce sync.Once
+	replyErr  error
+}
+
+func newFastOpenConn(conn *poolConn, header []byte) *fastOpenConn {
+	return &fastOpenConn{poolConn: conn, header: header, sent: make(chan struct{})}
+}
+
+// 发送请求头, payload为明文, 加密成数据帧和请求头一起发送
+func (c *fastOpenConn) open(payload []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.header == nil {
+		return false, nil
+	}
+	buf := c.appendFrames(c.header, payload)
+	c.header = nil
+	close(c.sent)
+	_, err := c.cipherConn.Conn.Write(buf)
+	return true, err
+}
+
+func (c *fastOpenConn) Write(b []byte) (int, error) {
+	ok, err := c.open(b)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return len(b), nil
+	}
+	return c.poolConn.Write(b)
+}
+
+// 应用先读取时最多等fastOpenWait, 仍然没有写入就单独发送请求头
+func (c *fastOpenConn) waitSent() error {
+	select {
+	case <-c.sent:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(fastOpenWait)
+	defer timer.Stop()
+	select {
+	case <-c.sent:
+		return nil
+	case <-timer.C:
+		_, err := c.open(nil)
+		return err
+	}
+}
+
+func (c *fastOpenConn) Read(b []byte) (int, error) {
+	err := c.waitSent()
+	if err != nil {
+		return 0, err
+	}
+	c.replyOnce.Do(func() {
+		resp, err := ReadReply(c.cipherConn.Conn, c.auth.Decrypt)
+		if err != nil {
+			// 本地关闭, 空闲超时和ctx取消都会中断读取, 只有服务端断开或者应答错误才标记不可用
+			if !errors.Is(err, net.ErrClosed) && !isTimeout(err) {
+				c.node.markDown(c.pool.backoff)
+			}
+			c.replyErr = err
+			return
+		}
+		if resp[1] != REP_SUCCEEDED {
+			c.replyErr = &ReplyError{Rep: resp[1]}
+		}
+	})
+	if c.replyErr != nil {
+		return 0, c.replyErr
+	}
+	return c.poolConn.Read(b)
+}
+
+// 应用没有发送数据就关闭发送方向时, 先发送请求头
+func (c *fastOpenConn) CloseWrite() error {
+	_, err := c.open(nil)
+	if err != nil {
+		return err
+	}
+	return c.poolConn.CloseWrite()
+}
+
+// 应答之前不知道服务端的绑定地址
+func (c *fastOpenConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+}
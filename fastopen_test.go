@@ -0,0 +1,152 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastOpen(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// 服务端先发送数据
+	banner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer banner.Close()
+	go func() {
+		for {
+			conn, err := banner.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 ready"))
+			conn.Close()
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg9", ServerOptions: ServerOptions{ACL: loopbackACL}})
+
+	// 接受连接但从不应答的服务端
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds: []string{"fast=server:random:abcedfg9@" + serverAddr, "silent=server:random:abcedfg9@" + silent.Addr().String()},
+		FastOpen:  true,
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+	fast := r.outbounds["fast"]
+
+	conn, err := fast.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	msg := []byte("hello")
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	resp := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, resp)
+	conn.Close()
+
+	conn, err = fast.DialContext(context.Background(), "tcp", banner.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	resp = make([]byte, len("220 ready"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "220 ready", string(resp))
+	conn.Close()
+
+	// 连不上目标时在读取时返回服务端的应答码
+	conn, err = fast.DialContext(context.Background(), "tcp", closedPort())
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.Write(msg)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(resp)
+	assert.Equal(t, byte(REP_CONNECTION_REFUSED), ReplyCode(err))
+	conn.Close()
+	assert.False(t, r.pools[0].nodes[0].isDown())
+
+	// 等待应答时本地超时或者关闭连接, 不是服务端的问题
+	node := r.pools[1].nodes[0]
+	conn, err = r.outbounds["silent"].DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.Write(msg)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(resp)
+	assert.True(t, isTimeout(err), err)
+	conn.Close()
+	assert.False(t, node.isDown())
+
+	conn, err = r.outbounds["silent"].DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.Write(msg)
+	time.AfterFunc(100*time.Millisecond, func() { conn.Close() })
+	_, err = conn.Read(resp)
+	assert.NotNil(t, err)
+	assert.False(t, node.isDown())
+}
+
+func TestFastOpenPerServer(t *testing.T) {
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg9", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	link := ShareLink{EncryType: "random", Passwd: "abcedfg9", Addr: serverAddr, FastOpen: true}.String()
+
+	// 只有分享链接要求fast_open的服务端使用0-RTT
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds: []string{"fast=server:" + link, "plain=server:random:abcedfg9@" + serverAddr},
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	conn, err := r.outbounds["fast"].Outbound.DialContext(context.Background(), "tcp", closedPort())
+	assert.Nil(t, err)
+	assert.IsType(t, &fastOpenConn{}, conn)
+	conn.Close()
+
+	_, err = r.outbounds["plain"].Outbound.DialContext(context.Background(), "tcp", closedPort())
+	assert.Equal(t, byte(REP_CONNECTION_REFUSED), ReplyCode(err))
+}
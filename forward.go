@@ -0,0 +1,400 @@
+package socks5proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// UDP会话空闲超时, 两个方向都没有数据时关闭隧道
+	udpSessionTimeout = 60 * time.Second
+	// UDP数据报最大长度
+	udpMaxDatagram = 65535
+)
+
+// 端口转发定义, 本地侦听地址 -> 固定的远程地址
+type Forward struct {
+	Network    string // tcp 或 udp
+	ListenAddr string
+	TargetAddr string
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s/%s->%s", f.Network, f.ListenAddr, f.TargetAddr)
+}
+
+// 解析ssh风格的端口转发定义:
+//
+//	[udp/|tcp/][bind_address:]port:host:hostport
+//
+// bind_address为空时侦听127.0.0.1, IPv6地址需要用[]括起来
+func ParseForward(spec string) (Forward, error) {
+	f := Forward{Network: "tcp"}
+	if strings.HasPrefix(spec, "udp/") {
+		f.Network = "udp"
+		spec = spec[4:]
+	} else if strings.HasPrefix(spec, "tcp/") {
+		spec = spec[4:]
+	}
+
+	parts := splitForwardSpec(spec)
+	var bind, port, host, hostport string
+	switch len(parts) {
+	case 3:
+		bind, port, host, hostport = "127.0.0.1", parts[0], parts[1], parts[2]
+	case 4:
+		bind, port, host, hostport = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return f, fmt.Errorf("端口转发格式错误, %s", spec)
+	}
+	if len(port) == 0 || len(host) == 0 || len(hostport) == 0 {
+		return f, fmt.Errorf("端口转发格式错误, %s", spec)
+	}
+
+	f.ListenAddr = net.JoinHostPort(strings.Trim(bind, "[]"), port)
+	f.TargetAddr = net.JoinHostPort(strings.Trim(host, "[]"), hostport)
+	return f, nil
+}
+
+// 按":"切分, 忽略[]中的":"
+func splitForwardSpec(spec string) []string {
+	var parts []string
+	depth := 0
+	last := 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, spec[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(parts, spec[last:])
+}
+
+// 端口转发和反向隧道的可选配置
+type ForwardOptions struct {
+	Timeouts  *Timeouts    // 超时设置, 为空时使用DefaultTimeouts
+	Logger    *slog.Logger // 为空时使用slog.Default()
+	AccessLog *AccessLog   // 每个转发的连接一条记录, UDP每个会话一条, 为空时不记录
+}
+
+func (o ForwardOptions) timeouts() Timeouts {
+	if o.Timeouts != nil {
+		return *o.Timeouts
+	}
+	return DefaultTimeouts
+}
+
+func (o ForwardOptions) logger(fwd Forward) *slog.Logger {
+	logger := o.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("forward", fwd.String())
+}
+
+// 本地端口转发, 每个连接都通过加密信道连到固定的远程地址
+// 服务端可以有多个, 按顺序failover. 配置错误或者侦听失败时返回错误,
+// ctx结束时停止侦听, 关闭转发中的连接并返回ctx.Err()
+func LocalForward(ctx context.Context, fwd Forward, serverAddrString string, encrytype string, passwd string, opts ForwardOptions) error {
+	endpoints, err := ParseServerList(serverAddrString, encrytype, passwd)
+	if err != nil {
+		return err
+	}
+	logger := opts.logger(fwd)
+	servers, err := newServerPool(endpoints, POLICY_FAILOVER, 0, logger)
+	if err != nil {
+		return err
+	}
+	defer servers.Close()
+
+	switch fwd.Network {
+	case "tcp":
+		err = serveTCPForward(ctx, fwd, servers, opts, logger)
+	case "udp":
+		err = serveUDPForward(ctx, fwd, servers, opts, logger)
+	default:
+		return fmt.Errorf("不支持的转发类型, %s", fwd.Network)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// logger带有转发定义
+func serveTCPForward(ctx context.Context, fwd Forward, servers *ServerPool, opts ForwardOptions, logger *slog.Logger) error {
+	timeouts := opts.timeouts()
+	request, err := BuildRequest(CMD_CONNECT, fwd.TargetAddr)
+	if err != nil {
+		return err
+	}
+
+	listenAddr, err := net.ResolveTCPAddr("tcp", fwd.ListenAddr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenTCP("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	logger.Info("forward")
+
+	// 和代理服务一样, accept临时出错时退避重试, listener关闭后返回.
+	// ctx已经结束, shutdown不等待, 直接关闭转发中的连接
+	var conns connTracker
+	stop := context.AfterFunc(ctx, func() {
+		conns.shutdown(ctx, logger)
+	})
+	defer stop()
+	return conns.serve(listener, logger, func(conn net.Conn) {
+		localClient := conn.(*net.TCPConn)
+		id := newConnID()
+		logger := logger.With("conn", id, "src", localClient.RemoteAddr().String())
+		rec := newForwardRecord(id, localClient.RemoteAddr().String(), fwd.TargetAddr)
+		defer opts.AccessLog.write(rec, logger)
+		ctx, cancel := timeouts.tunnelContext(conns.context())
+		dstServer, node, _, err := servers.dialTunnel(withConnID(ctx, id), request)
+		cancel()
+		if err != nil {
+			logger.Error("forward fail", "err", err)
+			rec.dialFail(err)
+			localClient.Close()
+			return
+		}
+		defer servers.release(node)
+		handleProxyRequest_Proxy(conns.context(), localClient, dstServer, node.auth, timeouts, logger, rec)
+	})
+}
+
+// 每个会话等待发往隧道的数据报数量, 隧道建立前或者发送太慢时超出的数据报丢弃
+const udpSessionQueue = 64
+
+// UDP端口转发, 每个来源地址一个会话, 会话在自己的goroutine中连接服务端和转发,
+// 读取本地数据报的循环只把数据报交给会话, 不会被某个会话阻塞.
+// 会话表由mu保护, 会话结束时自己从表中删除, 关闭后不再创建会话
+type udpForward struct {
+	fwd      Forward
+	servers  *ServerPool
+	request  []byte
+	conn     *net.UDPConn
+	timeouts Timeouts
+	opts     ForwardOptions
+	logger   *slog.Logger
+
+	ctx    context.Context // 关闭时取消, 关闭所有隧道
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type udpSession struct {
+	id       ConnID
+	peer     *net.UDPAddr
+	in       chan []byte // 本地收到的数据报
+	rec      *AccessRecord
+	up, down int64 // 原子操作
+}
+
+func serveUDPForward(ctx context.Context, fwd Forward, servers *ServerPool, opts ForwardOptions, logger *slog.Logger) error {
+	request, err := BuildRequest(CMD_UDP_TUNNEL, fwd.TargetAddr)
+	if err != nil {
+		return err
+	}
+
+	listenAddr, err := net.ResolveUDPAddr("udp", fwd.ListenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	logger.Info("forward")
+
+	f := &udpForward{
+		fwd:      fwd,
+		servers:  servers,
+		request:  request,
+		conn:     conn,
+		timeouts: opts.timeouts(),
+		opts:     opts,
+		logger:   logger,
+		sessions: make(map[string]*udpSession),
+	}
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	defer f.close()
+	// ctx结束时中断读取
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		f.dispatch(peer, buf[:n])
+	}
+}
+
+// 把数据报交给来源地址的会话, 没有会话时创建
+func (f *udpForward) dispatch(peer *net.UDPAddr, b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	session, ok := f.sessions[peer.String()]
+	if !ok {
+		id := newConnID()
+		session = &udpSession{
+			id:   id,
+			peer: peer,
+			in:   make(chan []byte, udpSessionQueue),
+			rec:  newForwardRecord(id, peer.String(), f.fwd.TargetAddr),
+		}
+		f.sessions[peer.String()] = session
+		f.wg.Add(1)
+		go f.serveSession(session)
+	}
+	select {
+	case session.in <- append([]byte(nil), b...):
+	default:
+		// 和UDP一样丢弃
+	}
+}
+
+func (f *udpForward) serveSession(session *udpSession) {
+	logger := f.logger.With("conn", session.id, "src", session.peer.String())
+	defer f.wg.Done()
+	defer f.opts.AccessLog.write(session.rec, logger)
+	// 从会话表中删除后, 这个来源之后的数据报创建新会话
+	defer f.remove(session)
+
+	ctx, cancel := f.timeouts.tunnelContext(f.ctx)
+	tunnel, node, _, err := f.servers.dialTunnel(withConnID(ctx, session.id), f.request)
+	cancel()
+	if err != nil {
+		logger.Error("forward fail", "err", err)
+		session.rec.dialFail(err)
+		return
+	}
+	defer f.servers.release(node)
+	defer func() {
+		// 和服务端一样, 空闲超时是UDP会话正常的结束
+		session.rec.done(atomic.LoadInt64(&session.up), atomic.LoadInt64(&session.down), nil)
+	}()
+	defer tunnel.Close()
+	stop := context.AfterFunc(f.ctx, func() { tunnel.Close() })
+	defer stop()
+
+	// ------------> 远程得到的数据报发回来源地址
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		rbuf := make([]byte, udpMaxDatagram)
+		for {
+			tunnel.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			nr, err := readDatagram(tunnel, node.auth, rbuf)
+			if err != nil {
+				return
+			}
+			f.conn.WriteToUDP(rbuf[:nr], session.peer)
+			atomic.AddInt64(&session.down, int64(nr))
+		}
+	}()
+
+	// -----------> 本地的数据报发往远程端
+	for {
+		select {
+		case b := <-session.in:
+			tunnel.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			err = writeDatagram(tunnel, node.auth, b)
+			if err != nil {
+				logger.Warn("write datagram fail", "err", err)
+				tunnel.Close()
+				<-readDone
+				return
+			}
+			atomic.AddInt64(&session.up, int64(len(b)))
+		case <-readDone:
+			return
+		}
+	}
+}
+
+func (f *udpForward) remove(session *udpSession) {
+	f.mu.Lock()
+	delete(f.sessions, session.peer.String())
+	f.mu.Unlock()
+}
+
+// 停止创建会话, 关闭所有隧道并等待会话结束
+func (f *udpForward) close() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	f.cancel()
+	f.wg.Wait()
+}
+
+// UDP数据报在加密信道中的帧格式:
+//
+//	+-----+---------+
+//	| LEN |  DATA   |
+//	+-----+---------+
+//	|  2  | 0-65535 |
+//	+-----+---------+
+func writeDatagram(w io.Writer, auth socks5Auth, b []byte) error {
+	if len(b) > udpMaxDatagram {
+		return errors.New("数据报太长")
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	err := auth.Encrypt(frame)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+func readDatagram(r io.Reader, auth socks5Auth, buf []byte) (int, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return 0, err
+	}
+	auth.Decrypt(head[:])
+	n := int(binary.BigEndian.Uint16(head[:]))
+	if n > len(buf) {
+		return 0, errors.New("数据报太长")
+	}
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	auth.Decrypt(buf[:n])
+	return n, nil
+}
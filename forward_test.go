@@ -0,0 +1,211 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForward(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Forward
+	}{
+		{"5432:db.internal:5432", Forward{"tcp", "127.0.0.1:5432", "db.internal:5432"}},
+		{"0.0.0.0:8080:10.0.0.1:80", Forward{"tcp", "0.0.0.0:8080", "10.0.0.1:80"}},
+		{"udp/5353:10.0.0.2:53", Forward{"udp", "127.0.0.1:5353", "10.0.0.2:53"}},
+		{"tcp/[::1]:8080:[fe80::1]:80", Forward{"tcp", "[::1]:8080", "[fe80::1]:80"}},
+	}
+	for _, c := range cases {
+		fwd, err := ParseForward(c.spec)
+		assert.Nil(t, err, c.spec)
+		assert.Equal(t, c.want, fwd, c.spec)
+	}
+
+	for _, spec := range []string{"", "8080", "8080:host", "a:b:c:d:e", ":host:80"} {
+		_, err := ParseForward(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestLocalForwardTCP(t *testing.T) {
+	// 目标服务, 原样返回
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg2", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	listen := closedPort()
+	timeouts := DefaultTimeouts
+	timeouts.Idle = 300 * time.Millisecond
+	accessPath := filepath.Join(t.TempDir(), "access.csv")
+	accessLog, err := NewAccessLog(accessPath, ACCESS_LOG_CSV, 0, 0)
+	assert.Nil(t, err)
+	defer accessLog.Close()
+	go LocalForward(context.Background(), Forward{"tcp", listen, echo.Addr().String()}, serverAddr, "random", "abcedfg2", ForwardOptions{Timeouts: &timeouts, AccessLog: accessLog})
+	waitListen(listen)
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello forward")
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	resp := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, resp)
+	// 使用传入的空闲超时, 而不是DefaultTimeouts
+	_, err = conn.Read(resp)
+	assert.Equal(t, io.EOF, err)
+	// 转发的连接也写访问日志, waitListen的连接也有一条
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(accessPath)
+		return strings.Contains(string(data), conn.LocalAddr().String())
+	}, time.Second, 10*time.Millisecond)
+	var row []string
+	for _, r := range readCSV(t, accessPath) {
+		if r[3] == conn.LocalAddr().String() {
+			row = r
+		}
+	}
+	assert.Equal(t, []string{"127.0.0.1", "13", "13", CLOSE_IDLE_TIMEOUT}, []string{row[4], row[8], row[9], row[11]})
+
+	// 配置错误或者侦听失败时返回错误, 不退出进程
+	assert.NotNil(t, LocalForward(context.Background(), Forward{"tcp", listen, echo.Addr().String()}, serverAddr, "random", "abcedfg2", ForwardOptions{}))
+	assert.NotNil(t, LocalForward(context.Background(), Forward{"sctp", closedPort(), echo.Addr().String()}, serverAddr, "random", "abcedfg2", ForwardOptions{}))
+	assert.NotNil(t, LocalForward(context.Background(), Forward{"tcp", closedPort(), echo.Addr().String()}, "", "random", "abcedfg2", ForwardOptions{}))
+}
+
+func TestLocalForwardUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, peer, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], peer)
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "simple", Passwd: "abcedfg3", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	listen := closedPort()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- LocalForward(ctx, Forward{"udp", listen, echo.LocalAddr().String()}, serverAddr, "simple", "abcedfg3", ForwardOptions{})
+	}()
+
+	conn, err := net.Dial("udp", listen)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	// 等待转发开始侦听, 之前发送的数据报会丢失
+	for i := 0; i < 100; i++ {
+		conn.Write([]byte("wait"))
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 2048)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, msg := range []string{"ping", "pong pong"} {
+		_, err = conn.Write([]byte(msg))
+		assert.Nil(t, err)
+		resp := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(resp)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, string(resp[:n]))
+	}
+
+	// ctx结束时关闭会话并返回
+	cancel()
+	select {
+	case err = <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("LocalForward did not return")
+	}
+}
+
+func TestLocalForwardShutdown(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg2", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	listen := closedPort()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- LocalForward(ctx, Forward{"tcp", listen, echo.Addr().String()}, serverAddr, "random", "abcedfg2", ForwardOptions{})
+	}()
+	waitListen(listen)
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	assert.Nil(t, err)
+
+	// 停止侦听并关闭转发中的连接
+	cancel()
+	select {
+	case err = <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("LocalForward did not return")
+	}
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = net.Dial("tcp", listen)
+	assert.NotNil(t, err)
+}
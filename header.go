@@ -0,0 +1,126 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// sckpy客户端和服务端之间的请求头, 连接建立后客户端一次发送, 服务端直接回应sock5应答,
+// 不再重放本地应用的sock5 greeting和请求
+//
+//	+--------+-----+-----+------+----------+----------+------+-----+---------+
+//	| LEN(2) | VER | CMD | ATYP | DST.ADDR | DST.PORT | PLEN | PAD | TAG(16) |
+//	+--------+-----+-----+------+----------+----------+------+-----+---------+
+//
+// LEN为之后部分的长度, 不加密, 之后的部分用用户的密码加密.
+// PAD为PLEN个字节, 前8字节为连接ID(大端), 之后为随机字节, 让请求头的长度不固定.
+// 没有连接ID(PLEN小于8)时服务端自己生成.
+// TAG = HMAC-SHA256(用户密码, LEN到PAD的明文)的前16字节, 服务端用它识别用户和校验请求头
+const (
+	HEADER_VERSION = 0x01
+
+	headerTagLen    = 16
+	headerMaxPad    = 64
+	headerMinLen    = 3 + 1 + 2 + 1 + headerTagLen
+	headerMaxLen    = 3 + 1 + 255 + 2 + 1 + 255 + headerTagLen
+	headerLenPrefix = 2
+)
+
+var ErrHeader = errors.New("请求头错误")
+
+// 用sock5请求(VER CMD RSV ATYP DST.ADDR DST.PORT)生成加密的请求头, 使用新的连接ID
+func BuildHeader(auth socks5Auth, passwd string, request []byte) ([]byte, error) {
+	return buildHeader(auth, passwd, request, newConnID())
+}
+
+func buildHeader(auth socks5Auth, passwd string, request []byte, id ConnID) ([]byte, error) {
+	if len(request) < 4 || request[0] != SOCKS_VERSION {
+		return nil, ErrRequest
+	}
+	random := make([]byte, headerMaxPad-connIDLen+1)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	pad := append(id.bytes(), random[1:1+int(random[0])%(headerMaxPad-connIDLen+1)]...)
+
+	body := []byte{HEADER_VERSION, request[1]}
+	body = append(body, request[3:]...)
+	body = append(body, byte(len(pad)))
+	body = append(body, pad...)
+
+	header := make([]byte, headerLenPrefix, headerLenPrefix+len(body)+headerTagLen)
+	binary.BigEndian.PutUint16(header, uint16(len(body)+headerTagLen))
+	header = append(header, body...)
+	header = append(header, headerTag(passwd, header)...)
+	err = auth.Encrypt(header[headerLenPrefix:])
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func headerTag(passwd string, b []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(passwd))
+	mac.Write(b)
+	return mac.Sum(nil)[:headerTagLen]
+}
+
+// 读取一个完整的请求头, 返回LEN和加密的部分, 之后的数据留给转发
+func readHeaderFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerLenPrefix)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header))
+	if n < headerMinLen || n > headerMaxLen {
+		return nil, ErrHeader
+	}
+	header = append(header, make([]byte, n)...)
+	_, err = io.ReadFull(r, header[headerLenPrefix:])
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// 校验解密后的请求头, 成功时返回其中的请求
+func parseHeader(passwd string, header []byte) (*Socks5Resolution, error) {
+	if len(header) < headerLenPrefix+headerMinLen || header[headerLenPrefix] != HEADER_VERSION {
+		return nil, ErrHeader
+	}
+	body := header[:len(header)-headerTagLen]
+	if !hmac.Equal(header[len(body):], headerTag(passwd, body)) {
+		return nil, ErrHeader
+	}
+
+	// 去掉VER, 还原成sock5请求解析
+	r := bytes.NewReader(body[headerLenPrefix+1:])
+	cmd, _ := r.ReadByte()
+	request := &Socks5Resolution{}
+	err := request.readFrom(io.MultiReader(bytes.NewReader([]byte{SOCKS_VERSION, cmd, 0x00}), r))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrHeader
+	}
+	if err != nil {
+		return request, err
+	}
+	plen, err := r.ReadByte()
+	if err != nil || r.Len() != int(plen) {
+		return nil, ErrHeader
+	}
+	if plen >= connIDLen {
+		id := make([]byte, connIDLen)
+		r.Read(id)
+		request.ID = ConnID(binary.BigEndian.Uint64(id))
+	} else {
+		request.ID = newConnID()
+	}
+	return request, nil
+}
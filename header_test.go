@@ -0,0 +1,67 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeader(t *testing.T) {
+	db, err := NewStaticUserDB("random", "abcedfg1")
+	if err != nil {
+		log.Panic(err)
+	}
+	user := db.users[0]
+
+	// 最长的域名, 请求头之后紧跟着数据, 按字节到达
+	domain := strings.Repeat("a", 251) + ".com"
+	request, err := BuildRequest(CMD_CONNECT, domain+":443")
+	if err != nil {
+		log.Panic(err)
+	}
+	header, err := BuildHeader(user.auth, user.Passwd, request)
+	assert.Nil(t, err)
+	r := iotest.OneByteReader(bytes.NewReader(append(header, "data"...)))
+	found, parsed, err := db.ReadHeader(r)
+	assert.Nil(t, err)
+	assert.Equal(t, user, found)
+	assert.Equal(t, byte(CMD_CONNECT), parsed.CMD)
+	assert.Equal(t, domain, parsed.DSTDOMAIN)
+	assert.Equal(t, uint16(443), parsed.DSTPORT)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "data", string(rest))
+
+	// 连接ID放在填充中
+	header, err = buildHeader(user.auth, user.Passwd, request, ConnID(0x0123456789abcdef))
+	assert.Nil(t, err)
+	_, parsed, err = db.ReadHeader(bytes.NewReader(header))
+	assert.Nil(t, err)
+	assert.Equal(t, ConnID(0x0123456789abcdef), parsed.ID)
+
+	// 篡改的请求头不能通过校验
+	for i := headerLenPrefix; i < len(header); i++ {
+		b := append([]byte(nil), header...)
+		b[i]++
+		_, _, err = db.ReadHeader(bytes.NewReader(b))
+		assert.NotNil(t, err, i)
+	}
+
+	// 长度错误和不完整的请求头
+	for _, b := range [][]byte{{0, 1, 0}, {0xFF, 0xFF}, header[:len(header)-1]} {
+		_, _, err = db.ReadHeader(bytes.NewReader(b))
+		assert.NotNil(t, err)
+	}
+
+	// 识别出用户后, 不支持的命令同时返回用户和应答码
+	request[1] = 0x7F
+	header, err = BuildHeader(user.auth, user.Passwd, request)
+	assert.Nil(t, err)
+	found, _, err = db.ReadHeader(bytes.NewReader(header))
+	assert.Equal(t, user, found)
+	assert.Equal(t, byte(REP_COMMAND_NOT_SUPPORTED), ReplyCode(err))
+}
@@ -0,0 +1,204 @@
+package socks5proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	// 成功率指数加权平均的权重
+	successEWMAWeight = 0.2
+)
+
+// 健康检查的探测数据, 目标为TCP echo服务时原样返回
+var probePayload = []byte("sckpy-probe\n")
+
+// 健康检查配置, Target为TCP echo服务的host:port, 或者返回2xx的http地址(例如 http://www.gstatic.com/generate_204)
+type HealthCheckOptions struct {
+	Target   string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// 服务端状态, 用于服务端选择和管理接口
+type ServerStatus struct {
+	Addr        string    `json:"addr"`
+	Up          bool      `json:"up"`
+	Active      int64     `json:"active"`
+	LatencyMs   float64   `json:"latency_ms"`
+	SuccessRate float64   `json:"success_rate"`
+	Probes      int       `json:"probes"`
+	LastCheck   time.Time `json:"last_check"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func (p *ServerPool) Status() []ServerStatus {
+	var status []ServerStatus
+	for _, n := range p.nodes {
+		n.mu.Lock()
+		status = append(status, ServerStatus{
+			Addr:        n.Addr,
+			Up:          !n.down,
+			Active:      atomic.LoadInt64(&n.active),
+			LatencyMs:   float64(n.latency) / float64(time.Millisecond),
+			SuccessRate: n.successRate,
+			Probes:      n.probes,
+			LastCheck:   n.lastCheck,
+			LastError:   n.lastErr,
+		})
+		n.mu.Unlock()
+	}
+	return status
+}
+
+// 启动后台健康检查, 定期通过每个服务端连接探测目标
+func (p *ServerPool) StartHealthCheck(opts HealthCheckOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultProbeInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultProbeTimeout
+	}
+	probe, err := newProbe(opts.Target)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&p.checking, 1)
+	p.bg.start(func(stop <-chan struct{}) {
+		for {
+			for _, n := range p.nodes {
+				// 不可用的服务端等退避时间结束后再探测
+				n.mu.Lock()
+				wait := n.down && time.Now().Before(n.downUntil)
+				n.mu.Unlock()
+				if !wait {
+					n := n
+					p.bg.start(func(<-chan struct{}) {
+						p.check(n, probe, opts.Timeout)
+					})
+				}
+			}
+			if !sleepOrStop(stop, opts.Interval) {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (p *ServerPool) check(n *serverNode, probe *healthProbe, timeout time.Duration) {
+	start := time.Now()
+	err := probe.run(n, timeout)
+	rtt := time.Since(start)
+
+	if err != nil {
+		n.markDown(p.backoff)
+	} else {
+		n.markUp(rtt)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sample := 0.0
+	n.lastErr = ""
+	if err == nil {
+		sample = 1
+	} else {
+		n.lastErr = err.Error()
+	}
+	if n.probes == 0 {
+		n.successRate = sample
+	} else {
+		n.successRate = successEWMAWeight*sample + (1-successEWMAWeight)*n.successRate
+	}
+	n.probes++
+	n.lastCheck = time.Now()
+}
+
+type healthProbe struct {
+	addr string
+	url  *url.URL // 为空时按TCP echo探测
+}
+
+func newProbe(target string) (*healthProbe, error) {
+	if len(target) == 0 {
+		return nil, errors.New("健康检查目标不能为空")
+	}
+	u, err := url.Parse(target)
+	if err == nil && u.Scheme == "http" {
+		addr := u.Host
+		if len(u.Port()) == 0 {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return &healthProbe{addr: addr, url: u}, nil
+	}
+	_, _, err = net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("健康检查目标错误, %s", target)
+	}
+	return &healthProbe{addr: target}, nil
+}
+
+// 完整握手并CONNECT到探测目标
+func (h *healthProbe) run(n *serverNode, timeout time.Duration) error {
+	request, err := BuildRequest(CMD_CONNECT, h.addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tunnel, _, err := dialTunnel(ctx, n.addr, n.auth, n.Passwd, request)
+	if err != nil {
+		return err
+	}
+	defer tunnel.Close()
+	tunnel.SetDeadline(time.Now().Add(timeout))
+	conn := &cipherConn{Conn: tunnel, auth: n.auth}
+
+	if h.url == nil {
+		_, err = conn.Write(probePayload)
+		if err != nil {
+			return err
+		}
+		resp := make([]byte, len(probePayload))
+		_, err = io.ReadFull(conn, resp)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(resp, probePayload) {
+			return errors.New("探测应答不一致")
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, h.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	err = req.Write(conn)
+	if err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("探测应答 %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package socks5proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg6", ServerOptions: ServerOptions{ACL: loopbackACL}})
+
+	pool, err := NewServerPool([]ServerEndpoint{
+		{closedPort(), "random", "abcedfg6", false},
+		{serverAddr, "random", "abcedfg6", false},
+	}, POLICY_LATENCY, time.Minute)
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	assert.NotNil(t, pool.StartHealthCheck(HealthCheckOptions{Target: "bad target"}))
+	err = pool.StartHealthCheck(HealthCheckOptions{Target: echo.Addr().String(), Interval: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	admin := httptest.NewServer(adminHandler(pool, nil, nil))
+	defer admin.Close()
+	// 等待几轮探测
+	time.Sleep(1 * time.Second)
+
+	resp, err := http.Get(admin.URL + "/status")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+	var status adminStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	assert.Nil(t, err)
+	assert.Len(t, status.Servers, 2)
+
+	// 第一个服务端不存在, 退避期间不再探测
+	assert.False(t, status.Servers[0].Up)
+	assert.Equal(t, 1, status.Servers[0].Probes)
+	assert.Equal(t, 0.0, status.Servers[0].SuccessRate)
+	assert.NotEmpty(t, status.Servers[0].LastError)
+
+	assert.True(t, status.Servers[1].Up)
+	assert.True(t, status.Servers[1].Probes > 1)
+	assert.Equal(t, 1.0, status.Servers[1].SuccessRate)
+	assert.True(t, status.Servers[1].LatencyMs > 0)
+
+	assert.Equal(t, serverAddr, pool.candidates()[0].Addr)
+}
@@ -0,0 +1,37 @@
+package socks5proxy
+
+import (
+	"net"
+)
+
+// 嵌入使用时的连接回调, 在处理连接的goroutine中同步调用, 不能阻塞太久
+type Hooks struct {
+	// 连接目标之前调用, 返回错误时拒绝请求, 回应SOCKS REP 0x02
+	OnConnect func(info *ConnInfo) error
+	// 转发结束后调用, 带上传下载的字节数和转发的错误.
+	// 每个代理请求结束时都会调用一次, 包括被访问控制, 路由规则或者OnConnect拒绝,
+	// 解析或者连接目标失败, 这时字节数为0, err为拒绝或者失败的原因
+	OnClose func(info *ConnInfo, up int64, down int64, err error)
+}
+
+// 一个代理请求的信息
+type ConnInfo struct {
+	ID     ConnID   // 连接ID, 客户端和服务端相同
+	User   string   // 服务端识别出的用户名, 客户端为空
+	Source net.Addr // 应用(客户端)或者sckpy客户端(服务端)的地址
+	Target string   // 目标地址, host:port
+	Route  string   // 客户端选择的出站名称, 服务端为空
+}
+
+func (h Hooks) connect(info *ConnInfo) error {
+	if h.OnConnect == nil {
+		return nil
+	}
+	return h.OnConnect(info)
+}
+
+func (h Hooks) close(info *ConnInfo, up int64, down int64, err error) {
+	if h.OnClose != nil {
+		h.OnClose(info, up, down, err)
+	}
+}
@@ -0,0 +1,175 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录拨号地址的拨号器
+type recordDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+"/"+addr)
+	d.mu.Unlock()
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+type closeEvent struct {
+	info     ConnInfo
+	up, down int64
+	err      error
+}
+
+func TestEmbed(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	var serverLog, clientLog bytes.Buffer
+	dialer := &recordDialer{}
+	serverClosed := make(chan closeEvent, 1)
+	// 和命令行一样总有上游规则, 规则为直连时使用Dialer
+	upstream, err := ParseUpstreamRules(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	server, err := NewProxyServer(ServerConfig{
+		EncryType:     "random",
+		Passwd:        "abcedfg15",
+		ServerOptions: ServerOptions{ACL: loopbackACL, Upstream: upstream},
+		Logger:        slog.New(slog.NewTextHandler(&serverLog, nil)),
+		Dialer:        dialer,
+		Hooks: Hooks{
+			OnClose: func(info *ConnInfo, up int64, down int64, err error) {
+				serverClosed <- closeEvent{*info, up, down, err}
+			},
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go server.Serve(sl)
+
+	clientClosed := make(chan closeEvent, 1)
+	// 第一个服务端连不上, 服务端池的日志也写入客户端的logger
+	client, err := NewProxyClient(ClientConfig{
+		ServerAddr:    closedPort() + "," + sl.Addr().String(),
+		EncryType:     "random",
+		Passwd:        "abcedfg15",
+		RecvHTTPProto: "sock5",
+		ClientOptions: ClientOptions{Rules: []string{"127.0.0.1=" + OUTBOUND_PROXY}},
+		Logger:        slog.New(slog.NewTextHandler(&clientLog, nil)),
+		Hooks: Hooks{
+			OnConnect: func(info *ConnInfo) error {
+				if strings.HasPrefix(info.Target, "blocked.example") {
+					return errors.New("blocked")
+				}
+				return nil
+			},
+			OnClose: func(info *ConnInfo, up int64, down int64, err error) {
+				clientClosed <- closeEvent{*info, up, down, err}
+			},
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	cl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go client.Serve(cl)
+
+	conn, rep := dialSocks5(cl.Addr().String(), target.Addr().String())
+	assert.Equal(t, byte(REP_SUCCEEDED), rep)
+	echo(t, conn, "hello")
+	conn.Close()
+
+	e := <-clientClosed
+	id := e.info.ID
+	assert.Equal(t, target.Addr().String(), e.info.Target)
+	assert.Equal(t, OUTBOUND_PROXY, e.info.Route)
+	assert.Equal(t, int64(5), e.up)
+	assert.Equal(t, int64(5), e.down)
+	e = <-serverClosed
+	// 服务端使用请求头中客户端的连接ID
+	assert.Equal(t, id, e.info.ID)
+	assert.Equal(t, DEFAULT_USER, e.info.User)
+	assert.Equal(t, target.Addr().String(), e.info.Target)
+	assert.Equal(t, int64(5), e.up)
+	assert.Equal(t, int64(5), e.down)
+	assert.Equal(t, []string{"tcp/" + target.Addr().String()}, dialer.addrs)
+
+	// OnConnect返回错误时拒绝请求, 同样调用OnClose
+	conn, rep = dialSocks5(cl.Addr().String(), "blocked.example:80")
+	assert.Equal(t, byte(REP_NOT_ALLOWED), rep)
+	conn.Close()
+	e = <-clientClosed
+	assert.Equal(t, "blocked.example:80", e.info.Target)
+	assert.EqualError(t, e.err, "blocked")
+
+	// 连不上目标时OnConnect之后也调用OnClose
+	dead := closedPort()
+	conn, rep = dialSocks5(cl.Addr().String(), dead)
+	assert.Equal(t, byte(REP_CONNECTION_REFUSED), rep)
+	conn.Close()
+	e = <-serverClosed
+	assert.Equal(t, dead, e.info.Target)
+	assert.Equal(t, []int64{0, 0}, []int64{e.up, e.down})
+	assert.NotNil(t, e.err)
+	e = <-clientClosed
+	assert.Equal(t, dead, e.info.Target)
+	assert.NotNil(t, e.err)
+
+	// 服务端访问控制拒绝时也调用OnClose
+	conn, rep = dialSocks5(cl.Addr().String(), "10.0.0.1:80")
+	assert.Equal(t, byte(REP_NOT_ALLOWED), rep)
+	conn.Close()
+	e = <-serverClosed
+	assert.Equal(t, "10.0.0.1:80", e.info.Target)
+	assert.Equal(t, byte(REP_NOT_ALLOWED), ReplyCode(e.err))
+	<-clientClosed
+
+	assert.Nil(t, client.Shutdown(context.Background()))
+	assert.Nil(t, server.Shutdown(context.Background()))
+	assert.Contains(t, clientLog.String(), `msg="rejected by hook" conn=`)
+	assert.Contains(t, clientLog.String(), "dst=blocked.example:80")
+	assert.Contains(t, serverLog.String(), "user=default")
+	assert.Contains(t, clientLog.String(), "conn="+id.String())
+	assert.Contains(t, serverLog.String(), "conn="+id.String())
+	assert.Contains(t, clientLog.String(), `msg="server dial fail" conn=`+id.String())
+	assert.Contains(t, clientLog.String(), `msg="server down"`)
+}
@@ -0,0 +1,79 @@
+// 客户端和服务端命令行共用的参数类型, 日志设置和信号处理
+package cli
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shikanon/socks5proxy"
+)
+
+// 可重复的命令行参数
+type StringList []string
+
+func (s *StringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *StringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *StringList) Get() interface{} {
+	return []string(*s)
+}
+
+// 按配置设置默认logger, 库中没有指定Logger的地方都使用它
+func SetupLog(c socks5proxy.LogConfig) {
+	w := io.Writer(os.Stderr)
+	if len(c.File) > 0 {
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w = f
+	}
+	h, err := c.Handler(w)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// 收到SIGINT/SIGTERM时优雅关闭, 等待连接结束最多timeout, 再次收到信号时立即退出
+func ServeUntilSignal(serve func() error, shutdown func(ctx context.Context) error, timeout time.Duration) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case s := <-sig:
+		slog.Info("shutting down, waiting for connections", "signal", s, "timeout", timeout)
+	}
+	go func() {
+		<-sig
+		slog.Warn("forced exit")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := shutdown(ctx)
+	if err != nil {
+		slog.Warn("shutdown", "err", err)
+	}
+	<-errc
+	slog.Info("shutdown done")
+}
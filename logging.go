@@ -0,0 +1,109 @@
+package socks5proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+)
+
+// 日志格式
+const (
+	LOG_FORMAT_TEXT = "text" // key=value
+	LOG_FORMAT_JSON = "json" // 每行一个json对象
+)
+
+// 日志级别, NewLogHandler创建的handler共用, 运行中可以通过管理接口的/log/level修改
+var LogLevel = new(slog.LevelVar)
+
+// 按格式创建日志handler, 级别为LogLevel
+func NewLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: LogLevel}
+	switch format {
+	case "", LOG_FORMAT_TEXT:
+		return slog.NewTextHandler(w, opts), nil
+	case LOG_FORMAT_JSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("不支持的日志格式, %s", format)
+}
+
+// 解析日志级别, debug, info, warn, error, 也可以带偏移, 例如 info+2. 为空时为info
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if len(s) == 0 {
+		return level, nil
+	}
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// http.Server的ErrorLog
+func errorLog(logger *slog.Logger) *log.Logger {
+	return slog.NewLogLogger(logger.Handler(), slog.LevelError)
+}
+
+// 管理接口的/log/level
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, LogLevel.Level())
+	case http.MethodPost:
+		level, err := ParseLogLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		LogLevel.Set(level)
+		slog.Info("log level changed", "level", level)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// 连接ID, 客户端生成后放在请求头中发给服务端, 两端同一个连接的日志使用相同的ID
+type ConnID uint64
+
+const connIDLen = 8
+
+func newConnID() ConnID {
+	return ConnID(rand.Uint64())
+}
+
+func (id ConnID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// 日志中输出为16位十六进制字符串, json中也不是数字
+func (id ConnID) LogValue() slog.Value {
+	return slog.StringValue(id.String())
+}
+
+// json中同样输出为字符串
+func (id ConnID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id ConnID) bytes() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+type connIDKey struct{}
+
+// 出站经过服务端时, 请求头使用ctx中的连接ID
+func withConnID(ctx context.Context, id ConnID) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// ctx中没有连接ID时生成新的
+func connIDFrom(ctx context.Context) ConnID {
+	if id, ok := ctx.Value(connIDKey{}).(ConnID); ok {
+		return id
+	}
+	return newConnID()
+}
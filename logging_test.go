@@ -0,0 +1,52 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogHandler(t *testing.T) {
+	defer LogLevel.Set(LogLevel.Level())
+
+	var buf bytes.Buffer
+	h, err := LogConfig{Level: "warn", Format: LOG_FORMAT_JSON}.Handler(&buf)
+	assert.Nil(t, err)
+	logger := slog.New(h).With("conn", ConnID(0xabc))
+	logger.Info("hidden")
+	logger.Warn("shown", "up", 5)
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "0000000000000abc", record["conn"])
+	assert.Equal(t, float64(5), record["up"])
+
+	_, err = LogConfig{Format: "xml"}.Handler(&buf)
+	assert.NotNil(t, err)
+	_, err = LogConfig{Level: "loud"}.Handler(&buf)
+	assert.NotNil(t, err)
+
+	// 运行中通过管理接口修改级别
+	admin := serverAdminHandler(&UserDB{}, nil)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/log/level?level=debug", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, slog.LevelDebug, LogLevel.Level())
+	w = httptest.NewRecorder()
+	adminHandler(nil, nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/log/level", nil))
+	assert.Equal(t, "DEBUG", strings.TrimSpace(w.Body.String()))
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/log/level?level=loud", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	buf.Reset()
+	slog.New(h).Debug("debug")
+	assert.Contains(t, buf.String(), `"msg":"debug"`)
+}
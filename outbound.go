@@ -0,0 +1,505 @@
+package socks5proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 内置出站名称
+const (
+	OUTBOUND_DIRECT = "direct" // 直连, 经过客户端配置的上游代理
+	OUTBOUND_REJECT = "reject" // 丢弃
+	OUTBOUND_PROXY  = "proxy"  // 经过-server指定的服务端
+)
+
+const (
+	defaultURLTestTarget   = "www.gstatic.com:80"
+	defaultURLTestInterval = 5 * time.Minute
+)
+
+var errRejected = errors.New("rejected by rule")
+
+// 出站, 路由规则按名称选择出站, 所有出站返回的连接都是明文的
+type Outbound interface {
+	Name() string
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// 直连或者经过上游代理
+type directOutbound struct {
+	name   string
+	dialer NetDialer
+}
+
+func (o *directOutbound) Name() string { return o.name }
+
+func (o *directOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return o.dialer.DialContext(ctx, network, addr)
+}
+
+type rejectOutbound struct {
+	name string
+}
+
+func (o *rejectOutbound) Name() string { return o.name }
+
+func (o *rejectOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errRejected
+}
+
+// 经过sckpy服务端的加密信道
+type serverOutbound struct {
+	name     string
+	pool     *ServerPool
+	fastOpen bool // 所有服务端都使用0-RTT, 不等待服务端应答
+}
+
+func (o *serverOutbound) Name() string { return o.name }
+
+func (o *serverOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	request, err := BuildRequest(CMD_CONNECT, addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, node, bind, err := o.pool.dialServer(ctx, request, o.fastOpen)
+	if err != nil {
+		return nil, err
+	}
+	if o.fastOpen || node.FastOpen {
+		header, err := buildHeader(node.auth, node.Passwd, request, connIDFrom(ctx))
+		if err != nil {
+			tunnel.Close()
+			o.pool.release(node)
+			return nil, err
+		}
+		return newFastOpenConn(&poolConn{cipherConn: cipherConn{Conn: tunnel, auth: node.auth}, pool: o.pool, node: node}, header), nil
+	}
+	// LocalAddr返回服务端应答的绑定地址, 客户端原样回应给应用
+	conn := &boundConn{Conn: tunnel, bind: bind}
+	return &poolConn{cipherConn: cipherConn{Conn: conn, auth: node.auth}, pool: o.pool, node: node}, nil
+}
+
+// 关闭时释放服务端连接数
+type poolConn struct {
+	cipherConn
+	pool *ServerPool
+	node *serverNode
+	once sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		c.pool.release(c.node)
+	})
+	return c.cipherConn.Close()
+}
+
+// 出站组类型
+const (
+	GROUP_FAILOVER = "failover" // 按顺序使用第一个能连通的出站
+	GROUP_URL_TEST = "url-test" // 定期测速, 使用延迟最低的出站
+	GROUP_SELECT   = "select"   // 手动选择, 默认第一个
+)
+
+type groupOutbound struct {
+	name    string
+	kind    string
+	members []Outbound
+	current int32 // select和url-test当前使用的出站
+}
+
+func (g *groupOutbound) Name() string { return g.name }
+
+func (g *groupOutbound) Selected() Outbound {
+	return g.members[atomic.LoadInt32(&g.current)]
+}
+
+// 手动选择出站, 只对select组有效
+func (g *groupOutbound) Select(name string) error {
+	if g.kind != GROUP_SELECT {
+		return fmt.Errorf("%s 不是select组", g.name)
+	}
+	for i, m := range g.members {
+		if m.Name() == name {
+			atomic.StoreInt32(&g.current, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("%s 中没有出站 %s", g.name, name)
+}
+
+func (g *groupOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if g.kind != GROUP_FAILOVER {
+		return g.Selected().DialContext(ctx, network, addr)
+	}
+	var err error
+	for _, m := range g.members {
+		var conn net.Conn
+		conn, err = m.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// 定期通过每个出站连接测试目标, 选择延迟最低的出站. 测速不计入出站统计
+func (g *groupOutbound) urlTestLoop(target string, interval time.Duration, logger *slog.Logger, stop <-chan struct{}) {
+	for {
+		best, bestRTT := -1, time.Duration(0)
+		for i, m := range g.members {
+			if s, ok := m.(*statsOutbound); ok {
+				m = s.Outbound
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), defaultProbeTimeout)
+			start := time.Now()
+			conn, err := m.DialContext(ctx, "tcp", target)
+			cancel()
+			if err != nil {
+				continue
+			}
+			rtt := time.Since(start)
+			conn.Close()
+			if best < 0 || rtt < bestRTT {
+				best, bestRTT = i, rtt
+			}
+		}
+		if best >= 0 && int32(best) != atomic.LoadInt32(&g.current) {
+			logger.Info("outbound selected", "group", g.name, "outbound", g.members[best].Name(), "rtt", bestRTT)
+			atomic.StoreInt32(&g.current, int32(best))
+		}
+		if !sleepOrStop(stop, interval) {
+			return
+		}
+	}
+}
+
+// 出站统计
+type OutboundStatus struct {
+	Name        string `json:"name"`
+	Selected    string `json:"selected,omitempty"`
+	Connections int64  `json:"connections"`
+	Active      int64  `json:"active"`
+	Failures    int64  `json:"failures"`
+	BytesUp     int64  `json:"bytes_up"`
+	BytesDown   int64  `json:"bytes_down"`
+}
+
+// 统计每个出站的连接数和流量
+type statsOutbound struct {
+	Outbound
+	connections int64
+	active      int64
+	failures    int64
+	up          int64
+	down        int64
+}
+
+func (o *statsOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt64(&o.connections, 1)
+	conn, err := o.Outbound.DialContext(ctx, network, addr)
+	if err != nil {
+		atomic.AddInt64(&o.failures, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&o.active, 1)
+	return &statsConn{Conn: conn, stats: o}, nil
+}
+
+func (o *statsOutbound) status() OutboundStatus {
+	s := OutboundStatus{
+		Name:        o.Name(),
+		Connections: atomic.LoadInt64(&o.connections),
+		Active:      atomic.LoadInt64(&o.active),
+		Failures:    atomic.LoadInt64(&o.failures),
+		BytesUp:     atomic.LoadInt64(&o.up),
+		BytesDown:   atomic.LoadInt64(&o.down),
+	}
+	if g, ok := o.Outbound.(*groupOutbound); ok {
+		s.Selected = g.Selected().Name()
+	}
+	return s
+}
+
+type statsConn struct {
+	net.Conn
+	stats *statsOutbound
+	once  sync.Once
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.stats.down, int64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.stats.up, int64(n))
+	return n, err
+}
+
+func (c *statsConn) underlying() net.Conn {
+	return c.Conn
+}
+
+func (c *statsConn) count(read int64, written int64) {
+	atomic.AddInt64(&c.stats.down, read)
+	atomic.AddInt64(&c.stats.up, written)
+}
+
+func (c *statsConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *statsConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.active, -1)
+	})
+	return c.Conn.Close()
+}
+
+type outboundRule struct {
+	suffix   string
+	outbound *statsOutbound
+}
+
+// 出站路由, 按规则把目标地址分配给命名的出站
+type OutboundRouter struct {
+	names     []string
+	outbounds map[string]*statsOutbound
+	rules     []outboundRule
+
+	// 出站使用的服务端池和url-test组的测速, Close时停止
+	pools []*ServerPool
+	bg    background
+
+	logger *slog.Logger
+	check  bool // 只检查配置, 不启动后台任务
+}
+
+// 出站路由配置
+type OutboundOptions struct {
+	Outbounds []string // 命名出站, "名称=定义", 见ParseOutbound
+	Rules     []string // 路由规则, "域名后缀=出站名称", 按顺序匹配, "*"匹配所有目标
+
+	// 服务端出站的默认加密方法, 密码和选择策略
+	EncryType string
+	Passwd    string
+	Policy    string
+	Backoff   time.Duration
+
+	// url-test组的测速目标和间隔
+	TestTarget   string
+	TestInterval time.Duration
+
+	// 服务端出站使用0-RTT, 见fastOpenConn
+	FastOpen bool
+
+	// direct出站使用的拨号器, 为空时使用net.Dialer
+	Dialer NetDialer
+
+	Logger *slog.Logger // 服务端池和测速的日志, 为空时使用slog.Default()
+}
+
+// 创建出站路由, 内置direct/reject/proxy三个出站, proxy为空时不创建. proxy由路由的Close关闭
+func NewOutboundRouter(proxy *ServerPool, upstream *UpstreamRouter, opts OutboundOptions) (*OutboundRouter, error) {
+	return newOutboundRouter(proxy, upstream, opts, false)
+}
+
+// check为true时只检查配置, 服务端池不启动后台恢复, url-test组不测速
+func newOutboundRouter(proxy *ServerPool, upstream *UpstreamRouter, opts OutboundOptions, check bool) (*OutboundRouter, error) {
+	r := &OutboundRouter{outbounds: make(map[string]*statsOutbound), logger: opts.Logger, check: check}
+	if r.logger == nil {
+		r.logger = slog.Default()
+	}
+	err := r.init(proxy, upstream, opts)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// 停止出站的后台任务, 包括proxy出站的服务端池
+func (r *OutboundRouter) Close() {
+	r.bg.close()
+	for _, p := range r.pools {
+		p.Close()
+	}
+}
+
+func (r *OutboundRouter) init(proxy *ServerPool, upstream *UpstreamRouter, opts OutboundOptions) error {
+	var direct NetDialer = &net.Dialer{}
+	if opts.Dialer != nil {
+		direct = opts.Dialer
+	}
+	if upstream != nil {
+		direct = upstream.withDirect(direct)
+	}
+	r.add(&directOutbound{name: OUTBOUND_DIRECT, dialer: direct})
+	r.add(&rejectOutbound{name: OUTBOUND_REJECT})
+	if proxy != nil {
+		r.pools = append(r.pools, proxy)
+		r.add(&serverOutbound{name: OUTBOUND_PROXY, pool: proxy, fastOpen: opts.FastOpen})
+	}
+
+	for _, spec := range opts.Outbounds {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return fmt.Errorf("出站格式错误, %s", spec)
+		}
+		name := spec[:i]
+		if _, ok := r.outbounds[name]; ok {
+			return fmt.Errorf("出站重复定义, %s", name)
+		}
+		o, err := r.parseOutbound(name, spec[i+1:], opts)
+		if err != nil {
+			return err
+		}
+		r.add(o)
+	}
+
+	for _, spec := range opts.Rules {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return fmt.Errorf("规则格式错误, %s", spec)
+		}
+		o, ok := r.outbounds[spec[i+1:]]
+		if !ok {
+			return fmt.Errorf("规则中的出站不存在, %s", spec)
+		}
+		r.rules = append(r.rules, outboundRule{suffix: domainSuffix(spec[:i]), outbound: o})
+	}
+	return nil
+}
+
+func (r *OutboundRouter) add(o Outbound) {
+	r.names = append(r.names, o.Name())
+	r.outbounds[o.Name()] = &statsOutbound{Outbound: o}
+}
+
+// 解析出站定义:
+//
+//	direct | reject
+//	server:<服务端列表>         例如 server:random:passwd@hk.example.com:18888
+//	upstream:<上游代理链>       例如 upstream:http://proxy.corp:3128
+//	failover:<出站,出站...>     按顺序使用第一个能连通的出站
+//	url-test:<出站,出站...>     定期测速, 使用延迟最低的出站
+//	select:<出站,出站...>       手动选择, 默认第一个
+//
+// 组只能引用已经定义的出站
+func (r *OutboundRouter) parseOutbound(name string, spec string, opts OutboundOptions) (Outbound, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "direct":
+		if opts.Dialer != nil {
+			return &directOutbound{name: name, dialer: opts.Dialer}, nil
+		}
+		return &directOutbound{name: name, dialer: &net.Dialer{}}, nil
+	case "reject":
+		return &rejectOutbound{name: name}, nil
+	case "server":
+		endpoints, err := ParseServerList(arg, opts.EncryType, opts.Passwd)
+		if err != nil {
+			return nil, err
+		}
+		newPool := newServerPool
+		if r.check {
+			newPool = parseServerPool
+		}
+		pool, err := newPool(endpoints, opts.Policy, opts.Backoff, r.logger)
+		if err != nil {
+			return nil, err
+		}
+		r.pools = append(r.pools, pool)
+		return &serverOutbound{name: name, pool: pool, fastOpen: opts.FastOpen}, nil
+	case "upstream":
+		d, err := ParseUpstream(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &directOutbound{name: name, dialer: d}, nil
+	case GROUP_FAILOVER, GROUP_URL_TEST, GROUP_SELECT:
+		g := &groupOutbound{name: name, kind: kind}
+		for _, member := range strings.Split(arg, ",") {
+			o, ok := r.outbounds[strings.TrimSpace(member)]
+			if !ok {
+				return nil, fmt.Errorf("出站组 %s 中的出站不存在, %s", name, member)
+			}
+			g.members = append(g.members, o)
+		}
+		if kind == GROUP_URL_TEST && !r.check {
+			target, interval := opts.TestTarget, opts.TestInterval
+			if len(target) == 0 {
+				target = defaultURLTestTarget
+			}
+			if interval <= 0 {
+				interval = defaultURLTestInterval
+			}
+			r.bg.start(func(stop <-chan struct{}) {
+				g.urlTestLoop(target, interval, r.logger, stop)
+			})
+		}
+		return g, nil
+	default:
+		return nil, fmt.Errorf("不支持的出站类型, %s", spec)
+	}
+}
+
+// 选择目标地址的出站, 先匹配路由规则, 没有匹配时按GetProxyType的内置名单.
+// "*"的规则后缀为空, 匹配所有目标, 和ParseUpstreamRules的默认规则相同
+func (r *OutboundRouter) Resolve(addr string) Outbound {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, rule := range r.rules {
+		if len(rule.suffix) == 0 || matchDomain(host, rule.suffix) {
+			return rule.outbound
+		}
+	}
+
+	switch GetProxyType(addr) {
+	case 0:
+		return r.outbounds[OUTBOUND_REJECT]
+	case 2:
+		return r.outbounds[OUTBOUND_DIRECT]
+	}
+	if o, ok := r.outbounds[OUTBOUND_PROXY]; ok {
+		return o
+	}
+	return r.outbounds[OUTBOUND_DIRECT]
+}
+
+// 出站组手动选择
+func (r *OutboundRouter) Select(group string, name string) error {
+	o, ok := r.outbounds[group]
+	if !ok {
+		return fmt.Errorf("出站不存在, %s", group)
+	}
+	g, ok := o.Outbound.(*groupOutbound)
+	if !ok {
+		return fmt.Errorf("%s 不是出站组", group)
+	}
+	return g.Select(name)
+}
+
+func (r *OutboundRouter) Status() []OutboundStatus {
+	var status []OutboundStatus
+	for _, name := range r.names {
+		status = append(status, r.outbounds[name].status())
+	}
+	return status
+}
@@ -0,0 +1,154 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundRouter(t *testing.T) {
+	_, err := NewOutboundRouter(nil, nil, OutboundOptions{Outbounds: []string{"bad"}})
+	assert.NotNil(t, err)
+	_, err = NewOutboundRouter(nil, nil, OutboundOptions{Outbounds: []string{"g=failover:missing"}})
+	assert.NotNil(t, err)
+	_, err = NewOutboundRouter(nil, nil, OutboundOptions{Rules: []string{"example.com=missing"}})
+	assert.NotNil(t, err)
+
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds: []string{
+			"block=reject",
+			"fo=failover:block,direct",
+			"manual=select:direct,block",
+		},
+		Rules: []string{
+			"ads.example.com=block",
+			"*.example.com=fo",
+			"manual.test=manual",
+			"corp.com=block",
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "block", r.Resolve("x.ads.example.com:443").Name())
+	assert.Equal(t, "fo", r.Resolve("www.example.com:443").Name())
+	assert.Equal(t, "fo", r.Resolve("WWW.Example.com:443").Name())
+	// 按域名边界匹配
+	assert.Equal(t, "block", r.Resolve("corp.com:443").Name())
+	assert.NotEqual(t, "block", r.Resolve("evilcorp.com:443").Name())
+	assert.NotEqual(t, "fo", r.Resolve("evilexample.com:443").Name())
+	// 内置名单
+	assert.Equal(t, OUTBOUND_DIRECT, r.Resolve("github.com:443").Name())
+	assert.Equal(t, OUTBOUND_REJECT, r.Resolve("").Name())
+	// 没有proxy出站时直连
+	assert.Equal(t, OUTBOUND_DIRECT, r.Resolve("www.google.com:443").Name())
+
+	// select组
+	assert.NotNil(t, r.Select("fo", "direct"))
+	assert.NotNil(t, r.Select("manual", "missing"))
+	assert.Nil(t, r.Select("manual", "block"))
+	_, err = r.Resolve("manual.test:80").DialContext(context.Background(), "tcp", "manual.test:80")
+	assert.Equal(t, errRejected, err)
+}
+
+func TestOutboundCatchAllAndURLTest(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds:    []string{"block=reject", "auto=url-test:block,direct"},
+		Rules:        []string{"ads.example.com=block", "*=auto"},
+		TestTarget:   target.Addr().String(),
+		TestInterval: time.Hour,
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	// "*"匹配所有目标, 包括内置名单中的域名
+	assert.Equal(t, "block", r.Resolve("ads.example.com:443").Name())
+	assert.Equal(t, "auto", r.Resolve("github.com:443").Name())
+	assert.Equal(t, "auto", r.Resolve("1.2.3.4:80").Name())
+
+	// 测速不计入成员出站的统计
+	assert.Eventually(t, func() bool {
+		return r.outbounds["auto"].status().Selected == OUTBOUND_DIRECT
+	}, 2*time.Second, 10*time.Millisecond)
+	for _, s := range r.Status() {
+		assert.Equal(t, int64(0), s.Connections, s.Name)
+		assert.Equal(t, int64(0), s.Failures, s.Name)
+	}
+}
+
+func TestOutboundProxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg7", ServerOptions: ServerOptions{ACL: loopbackACL}})
+
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds: []string{
+			"dead=server:random:abcedfg7@" + closedPort(),
+			"hk=server:random:abcedfg7@" + serverAddr,
+			"fo=failover:dead,hk",
+		},
+		Rules: []string{"127.0.0.1=fo"},
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	addr := echo.Addr().String()
+	conn, err := r.Resolve(addr).DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		log.Panic(err)
+	}
+	msg := []byte("hello outbound")
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	resp := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, resp)
+
+	stats := make(map[string]OutboundStatus)
+	for _, s := range r.Status() {
+		stats[s.Name] = s
+	}
+	assert.Equal(t, int64(1), stats["dead"].Failures)
+	assert.Equal(t, int64(1), stats["hk"].Active)
+	assert.Equal(t, int64(len(msg)), stats["hk"].BytesUp)
+	assert.Equal(t, int64(len(msg)), stats["fo"].BytesDown)
+
+	conn.Close()
+	for _, s := range r.Status() {
+		assert.Equal(t, int64(0), s.Active, s.Name)
+	}
+}
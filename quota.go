@@ -0,0 +1,341 @@
+package socks5proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 流量计数写入文件的间隔
+	quotaSaveInterval = 30 * time.Second
+)
+
+var errQuotaExceeded = errors.New("流量配额已用完")
+
+// 用户限制, 0为不限制
+type UserLimits struct {
+	UploadRate   int64 // 上传速度, 字节/秒
+	DownloadRate int64 // 下载速度, 字节/秒
+	DailyQuota   int64 // 每日流量(上传+下载), 字节
+	MonthlyQuota int64 // 每月流量(上传+下载), 字节
+}
+
+// 解析用户文件中用户的限制, 例如 up=1M down=4M daily=10G monthly=200G
+func parseUserLimits(items []string) (UserLimits, error) {
+	var limits UserLimits
+	for _, item := range items {
+		i := strings.Index(item, "=")
+		if i < 0 {
+			return limits, fmt.Errorf("限制格式错误, %s", item)
+		}
+		n, err := ParseSize(item[i+1:])
+		if err != nil {
+			return limits, err
+		}
+		switch item[:i] {
+		case "up":
+			limits.UploadRate = n
+		case "down":
+			limits.DownloadRate = n
+		case "daily":
+			limits.DailyQuota = n
+		case "monthly":
+			limits.MonthlyQuota = n
+		default:
+			return limits, fmt.Errorf("未知的限制, %s", item)
+		}
+	}
+	return limits, nil
+}
+
+// 解析字节数, 支持K/M/G/T后缀(1024进制), 例如 512K, 10G
+func ParseSize(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := int64(1)
+	if len(v) > 0 {
+		switch v[len(v)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("字节数错误, %s", s)
+	}
+	return n * unit, nil
+}
+
+// 令牌桶限速, 令牌不足时欠账并等待, 为nil时不限速
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// 等待令牌, ctx结束时不再等待并返回ctx.Err()
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	// 桶容量为1秒的流量
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 流量计数, 按自然日和自然月清零
+type quotaCounter struct {
+	Day     string `json:"day"`
+	Daily   int64  `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int64  `json:"monthly"`
+}
+
+func (q *quotaCounter) roll(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if q.Day != day {
+		q.Day, q.Daily = day, 0
+	}
+	if q.Month != month {
+		q.Month, q.Monthly = month, 0
+	}
+}
+
+// 配额是否已用完, 用完时返回原因
+func (u *User) exhausted() string {
+	u.stats.mu.Lock()
+	defer u.stats.mu.Unlock()
+	u.stats.quota.roll(time.Now())
+	if u.Limits.DailyQuota > 0 && u.stats.quota.Daily >= u.Limits.DailyQuota {
+		return "daily"
+	}
+	if u.Limits.MonthlyQuota > 0 && u.stats.quota.Monthly >= u.Limits.MonthlyQuota {
+		return "monthly"
+	}
+	return ""
+}
+
+func (u *User) charge(n int) {
+	u.stats.mu.Lock()
+	u.stats.quota.roll(time.Now())
+	u.stats.quota.Daily += int64(n)
+	u.stats.quota.Monthly += int64(n)
+	u.stats.dirty = true
+	u.stats.mu.Unlock()
+}
+
+// 配额用完时结束连接, 同一个用户每次用完只记录一次, logger为触发的连接的日志
+func (u *User) checkQuota(logger *slog.Logger) error {
+	reason := u.exhausted()
+	if len(reason) == 0 {
+		return nil
+	}
+	u.stats.mu.Lock()
+	first := u.stats.exhausted != u.stats.quota.Day+reason
+	u.stats.exhausted = u.stats.quota.Day + reason
+	u.stats.mu.Unlock()
+	if first {
+		logger.Warn("quota exhausted", "quota", reason)
+	}
+	return errQuotaExceeded
+}
+
+// 用户的目标连接, 写入为上传, 读取为下载, 按用户和全局限速并计入配额.
+// ctx为转发的ctx, 结束时不再等待限速
+type userConn struct {
+	net.Conn
+	ctx    context.Context
+	user   *User
+	logger *slog.Logger
+}
+
+func (c *userConn) Write(b []byte) (int, error) {
+	err := c.user.checkQuota(c.logger)
+	if err != nil {
+		return 0, err
+	}
+	err = c.user.waitUp(c.ctx, len(b))
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	c.user.charge(n)
+	return n, err
+}
+
+func (c *userConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *userConn) Read(b []byte) (int, error) {
+	err := c.user.checkQuota(c.logger)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.user.charge(n)
+		if werr := c.user.waitDown(c.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (u *User) waitUp(ctx context.Context, n int) error {
+	err := u.upLimiter.wait(ctx, n)
+	if err != nil {
+		return err
+	}
+	return u.global.up.wait(ctx, n)
+}
+
+func (u *User) waitDown(ctx context.Context, n int) error {
+	err := u.downLimiter.wait(ctx, n)
+	if err != nil {
+		return err
+	}
+	return u.global.down.wait(ctx, n)
+}
+
+// 全局限速, 所有用户共用
+type globalLimiter struct {
+	up   *rateLimiter
+	down *rateLimiter
+}
+
+// 设置所有用户共用的上传和下载速度, 字节/秒, 0为不限制
+func (db *UserDB) SetGlobalRateLimit(up int64, down int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.global.up = newRateLimiter(up)
+	db.global.down = newRateLimiter(down)
+}
+
+// 从文件加载流量计数, 并在后台定期写回, 服务重启后配额继续累计
+func (db *UserDB) PersistQuota(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	counters := make(map[string]quotaCounter)
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &counters)
+		if err != nil {
+			return fmt.Errorf("%s, %v", path, err)
+		}
+	}
+
+	db.mu.Lock()
+	for name, q := range counters {
+		stats, ok := db.stats[name]
+		if !ok {
+			stats = &userStats{}
+			db.stats[name] = stats
+		}
+		stats.mu.Lock()
+		stats.quota = q
+		stats.mu.Unlock()
+	}
+	db.mu.Unlock()
+
+	db.bg.start(func(stop <-chan struct{}) {
+		for sleepOrStop(stop, quotaSaveInterval) {
+			err := db.saveQuota(path)
+			if err != nil {
+				db.log().Error("save quota fail", "err", err)
+			}
+		}
+	})
+	return nil
+}
+
+// 写入成功后才清除修改标记, 写入失败时下次重试.
+// 写入期间又有流量的用户保留标记, 下次再写
+func (db *UserDB) saveQuota(path string) error {
+	counters := make(map[string]quotaCounter)
+	saved := make(map[string]*userStats)
+	dirty := false
+	db.mu.RLock()
+	for name, stats := range db.stats {
+		stats.mu.Lock()
+		counters[name] = stats.quota
+		dirty = dirty || stats.dirty
+		stats.mu.Unlock()
+		saved[name] = stats
+	}
+	db.mu.RUnlock()
+	if !dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(counters, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名, 避免写到一半时文件损坏
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	for name, stats := range saved {
+		stats.mu.Lock()
+		if stats.quota == counters[name] {
+			stats.dirty = false
+		}
+		stats.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, n := range map[string]int64{"0": 0, "512": 512, "4k": 4096, "10M": 10 << 20, "2GB": 2 << 30, "1T": 1 << 40} {
+		v, err := ParseSize(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, n, v, s)
+	}
+	for _, s := range []string{"", "M", "-1", "1X"} {
+		_, err := ParseSize(s)
+		assert.NotNil(t, err, s)
+	}
+
+	limits, err := parseUserLimits([]string{"up=1M", "down=2M", "daily=1G", "monthly=10G"})
+	assert.Nil(t, err)
+	assert.Equal(t, UserLimits{1 << 20, 2 << 20, 1 << 30, 10 << 30}, limits)
+	_, err = parseUserLimits([]string{"speed=1M"})
+	assert.NotNil(t, err)
+	_, err = parseUserLimits([]string{"up"})
+	assert.NotNil(t, err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	var none *rateLimiter
+	assert.Nil(t, none.wait(context.Background(), 1<<30))
+
+	l := newRateLimiter(5000)
+	start := time.Now()
+	// 桶里有1秒的令牌, 超出部分按速度等待
+	assert.Nil(t, l.wait(context.Background(), 5000))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.Nil(t, l.wait(context.Background(), 1000))
+	assert.True(t, time.Since(start) >= 180*time.Millisecond)
+
+	// ctx结束时不再等待
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	assert.Equal(t, context.DeadlineExceeded, l.wait(ctx, 50000))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestUserQuota(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users")
+	quotaPath := filepath.Join(dir, "quota.json")
+	writeUserFile(path, "alice random abcedfg1 daily=16\n")
+	db, err := LoadUserDB(path)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	serverAddr := startTestServer(t, ServerConfig{ServerOptions: ServerOptions{Users: db, QuotaFile: quotaPath, ACL: loopbackACL}})
+
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds: []string{"alice=server:random:abcedfg1@" + serverAddr},
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	addr := echo.Addr().String()
+	conn, err := r.outbounds["alice"].DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	msg := []byte("0123456789")
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	resp := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+
+	// 上传和下载共20字节, 超过每日配额, 服务端关闭连接
+	conn.Write(msg)
+	_, err = io.ReadFull(conn, resp)
+	assert.NotNil(t, err)
+
+	// 配额用完后不能建立新连接
+	_, err = r.outbounds["alice"].DialContext(context.Background(), "tcp", addr)
+	assert.NotNil(t, err)
+
+	// 写入失败时保留修改标记, 下次重试
+	assert.NotNil(t, db.saveQuota(filepath.Join(quotaPath, "missing", "quota.json")))
+	// 流量计数写入文件, 重启后继续累计
+	assert.Nil(t, db.saveQuota(quotaPath))
+	db2, err := LoadUserDB(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	assert.Nil(t, db2.PersistQuota(quotaPath))
+	assert.Equal(t, int64(20), db2.Status()[0].DailyBytes)
+}
@@ -0,0 +1,282 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 转发缓冲区大小, 额外的容量留给cipherConn的帧头, 加密一个缓冲区的数据不需要重新分配
+const (
+	relayBufferSize  = 32 * 1024
+	relayBufferExtra = 2 * (relayBufferSize/cipherFrameSize + 1)
+)
+
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, relayBufferSize, relayBufferSize+relayBufferExtra)
+		return &b
+	},
+}
+
+func getRelayBuffer() *[]byte {
+	return relayBufferPool.Get().(*[]byte)
+}
+
+func putRelayBuffer(b *[]byte) {
+	relayBufferPool.Put(b)
+}
+
+// 支持半关闭的连接, *net.TCPConn和加密信道的cipherConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// 关闭发送方向, 对端读到EOF后仍然可以继续发送. 不支持半关闭的连接直接关闭
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// 双向转发, Left为靠近客户端的一端, Right为目标一端.
+// 一个方向读到EOF时半关闭对端, 另一个方向继续, 两个方向都结束后Run返回;
+// 出错, 空闲超时, 超过最长时间或者ctx取消时关闭两端
+type Relay struct {
+	Left  net.Conn // 加密信道用cipherConn包装
+	Right net.Conn
+
+	Timeouts Timeouts
+	counters *timeoutCounters // 空闲和最长时间超时的计数, 为nil时不计数
+
+	up   int64 // Left->Right的字节数, 原子操作
+	down int64 // Right->Left的字节数, 原子操作
+	last int64 // 最后一次读到数据的时间, UnixNano, 原子操作
+
+	mu  sync.Mutex
+	err error // 超时或取消的原因
+}
+
+// 已转发的字节数, 转发过程中也可以调用
+func (r *Relay) Up() int64   { return atomic.LoadInt64(&r.up) }
+func (r *Relay) Down() int64 { return atomic.LoadInt64(&r.down) }
+
+// 转发直到两个方向都结束, 返回第一个错误, 超时和取消时返回超时错误或ctx.Err()
+func (r *Relay) Run(ctx context.Context) error {
+	r.touch()
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		r.watch(ctx, done)
+	}()
+
+	var upErr, downErr error
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		upErr = r.copy(r.Right, r.Left, &r.up)
+		if upErr != nil {
+			r.close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		downErr = r.copy(r.Left, r.Right, &r.down)
+		if downErr != nil {
+			r.close()
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-watched
+
+	// 超时关闭导致的读写错误按超时返回
+	r.mu.Lock()
+	err := r.err
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if upErr != nil {
+		return upErr
+	}
+	return downErr
+}
+
+func (r *Relay) copy(dst net.Conn, src net.Conn, counter *int64) error {
+	dstTCP, dstWrappers := unwrapTCP(dst)
+	srcTCP, srcWrappers := unwrapTCP(src)
+	if dstTCP != nil && srcTCP != nil {
+		return r.splice(dst, dstTCP, srcTCP, counter, func(n int64) {
+			for _, w := range srcWrappers {
+				w.count(n, 0)
+			}
+			for _, w := range dstWrappers {
+				w.count(0, n)
+			}
+		})
+	}
+
+	bp := getRelayBuffer()
+	defer putRelayBuffer(bp)
+	buf := (*bp)[:relayBufferSize]
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			r.touch()
+			nw, ew := dst.Write(buf[:nr])
+			atomic.AddInt64(counter, int64(nw))
+			if ew != nil {
+				return ew
+			}
+			if nw != nr {
+				return io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return closeWrite(dst)
+		}
+		if er != nil {
+			return er
+		}
+	}
+}
+
+// 两端都是TCP连接并且不需要变换时用ReadFrom转发, Linux上为splice(2)零拷贝, 数据不经过用户空间.
+// splice过程中没有每次读取的回调, 有超时设置时按检查间隔设置读超时, 返回时计入字节数和活动时间,
+// 空闲和最长时间仍然由watch判断
+func (r *Relay) splice(dst net.Conn, dstTCP *net.TCPConn, srcTCP *net.TCPConn, counter *int64, count func(n int64)) error {
+	interval := r.checkInterval()
+	for {
+		if interval > 0 {
+			srcTCP.SetReadDeadline(time.Now().Add(interval))
+		}
+		n, err := dstTCP.ReadFrom(srcTCP)
+		if n > 0 {
+			r.touch()
+			atomic.AddInt64(counter, n)
+			count(n)
+		}
+		if err == nil {
+			return closeWrite(dst)
+		}
+		if interval > 0 && isTimeout(err) {
+			continue
+		}
+		return err
+	}
+}
+
+func (r *Relay) touch() {
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
+}
+
+func (r *Relay) close() {
+	r.Left.Close()
+	r.Right.Close()
+}
+
+func (r *Relay) stop(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+	r.close()
+}
+
+// 空闲时间和最长时间的检查间隔, 为较短的超时的1/10, 没有超时设置时为0
+func (r *Relay) checkInterval() time.Duration {
+	t := r.Timeouts
+	interval := t.Idle
+	if interval <= 0 || (t.Lifetime > 0 && t.Lifetime < interval) {
+		interval = t.Lifetime
+	}
+	if interval <= 0 {
+		return 0
+	}
+	interval /= 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	if interval > time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// 检查空闲时间和最长时间, ctx取消时关闭两端
+func (r *Relay) watch(ctx context.Context, done chan struct{}) {
+	t := r.Timeouts
+	interval := r.checkInterval()
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	} else if ctx.Done() == nil {
+		return
+	}
+
+	start := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			r.stop(ctx.Err())
+			return
+		case now := <-tick:
+			last := time.Unix(0, atomic.LoadInt64(&r.last))
+			switch {
+			case t.Lifetime > 0 && now.Sub(start) >= t.Lifetime:
+				if r.counters != nil {
+					atomic.AddInt64(&r.counters.lifetime, 1)
+				}
+				r.stop(errLifetimeExceeded)
+				return
+			case t.Idle > 0 && now.Sub(last) >= t.Idle:
+				if r.counters != nil {
+					atomic.AddInt64(&r.counters.idle, 1)
+				}
+				r.stop(errIdleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// 包装了其他连接并且只做统计的连接(例如出站统计), 零拷贝转发时直接使用底层连接,
+// 转发的字节数通过count计入
+type countingConn interface {
+	net.Conn
+	underlying() net.Conn
+	count(read int64, written int64)
+}
+
+// 找到可以零拷贝转发的TCP连接, 返回连接和经过的统计包装
+func unwrapTCP(c net.Conn) (*net.TCPConn, []countingConn) {
+	var wrappers []countingConn
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, wrappers
+		case countingConn:
+			wrappers = append(wrappers, v)
+			c = v.underlying()
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// 按超时设置转发, ctx取消时关闭两端, 返回上传和下载的字节数. 空闲和最长时间超时计入counters
+func relay(ctx context.Context, left net.Conn, right net.Conn, timeouts Timeouts, counters *timeoutCounters) (int64, int64, error) {
+	r := &Relay{Left: left, Right: right, Timeouts: timeouts, counters: counters}
+	err := r.Run(ctx)
+	return r.Up(), r.Down(), err
+}
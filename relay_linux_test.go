@@ -0,0 +1,84 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 隐藏*net.TCPConn, 强制使用用户空间缓冲转发
+type plainConn struct {
+	net.Conn
+}
+
+func (c plainConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// 进程用掉的CPU时间(用户态+内核态)
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func benchmarkRelayCPU(b *testing.B, wrap func(c net.Conn) net.Conn) {
+	start := cpuTime()
+	benchmarkRelay(b, nil, func(left net.Conn, right net.Conn) {
+		(&Relay{Left: wrap(left), Right: wrap(right)}).Run(context.Background())
+	})
+	b.ReportMetric(float64(cpuTime()-start)/float64(b.N), "cpu-ns/op")
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelayCPU(b, func(c net.Conn) net.Conn { return plainConn{c} })
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelayCPU(b, func(c net.Conn) net.Conn { return c })
+}
+
+func TestRelaySplice(t *testing.T) {
+	app, left := tcpPair()
+	right, target := tcpPair()
+	defer app.Close()
+	defer target.Close()
+
+	// 经过出站统计包装仍然走splice, 字节数计入出站统计
+	o := &statsOutbound{}
+	tcp, wrappers := unwrapTCP(&statsConn{Conn: right, stats: o})
+	assert.Equal(t, right, tcp)
+	assert.Equal(t, 1, len(wrappers))
+	tcp, _ = unwrapTCP(plainConn{right})
+	assert.Nil(t, tcp)
+
+	done := make(chan struct{})
+	var up, down int64
+	go func() {
+		up, down, _ = relay(context.Background(), left, &statsConn{Conn: right, stats: o}, Timeouts{Idle: time.Second}, nil)
+		close(done)
+	}()
+
+	// 半关闭后另一个方向继续转发
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	buf, err := io.ReadAll(target)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+	target.Write([]byte("world!"))
+	target.CloseWrite()
+	buf, err = io.ReadAll(app)
+	assert.Nil(t, err)
+	assert.Equal(t, "world!", string(buf))
+
+	<-done
+	assert.Equal(t, int64(5), up)
+	assert.Equal(t, int64(6), down)
+	assert.Equal(t, int64(5), o.up)
+	assert.Equal(t, int64(6), o.down)
+}
@@ -0,0 +1,215 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCipherConnFrames(t *testing.T) {
+	auth, err := CreateAuth("random", "abcedfg12")
+	if err != nil {
+		log.Panic(err)
+	}
+	a, b := net.Pipe()
+	w := &cipherConn{Conn: a, auth: auth}
+	r := &cipherConn{Conn: b, auth: auth}
+
+	// 超过一帧的数据, 关闭帧之后读到EOF
+	msg := bytes.Repeat([]byte("0123456789"), cipherFrameSize/5)
+	go func() {
+		w.Write(msg)
+		w.CloseWrite()
+		a.Close()
+	}()
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, data)
+
+	// 没有关闭帧就断开
+	c, d := net.Pipe()
+	go func() {
+		(&cipherConn{Conn: c, auth: auth}).Write(msg[:10])
+		c.Close()
+	}()
+	_, err = io.ReadAll(&cipherConn{Conn: d, auth: auth})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestHalfClose(t *testing.T) {
+	// 读到EOF后才回应收到的长度, 类似 nc -N
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(io.Discard, conn)
+				fmt.Fprintf(conn, "n=%d", n)
+			}()
+		}
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg12", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	clientAddr := startTestClient(t, ClientConfig{
+		ServerAddr:    serverAddr,
+		EncryType:     "random",
+		Passwd:        "abcedfg12",
+		RecvHTTPProto: "sock5",
+		ClientOptions: ClientOptions{Rules: []string{"127.0.0.1=" + OUTBOUND_PROXY}},
+	})
+
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{SOCKS_VERSION, 0x01, METHOD_CODE})
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	assert.Nil(t, err)
+	request, err := BuildRequest(CMD_CONNECT, target.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.Write(request)
+	reply, err := ReadReply(conn, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(REP_SUCCEEDED), reply[1])
+
+	msg := bytes.Repeat([]byte("x"), 100000)
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	assert.Nil(t, conn.(*net.TCPConn).CloseWrite())
+	resp, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "n=100000", string(resp))
+}
+
+func TestRelayCancel(t *testing.T) {
+	app, left := tcpPair()
+	right, target := tcpPair()
+	defer app.Close()
+	defer target.Close()
+
+	// 目标一端为加密信道, 转发过程中可以读取计数
+	auth := benchAuth()
+	r := &Relay{Left: left, Right: &cipherConn{Conn: right, auth: auth}}
+	peer := &cipherConn{Conn: target, auth: auth}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.Run(ctx)
+	}()
+
+	app.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(peer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+	peer.Write([]byte("world"))
+	_, err = io.ReadFull(app, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf))
+	assert.Equal(t, int64(5), r.Up())
+	assert.Equal(t, int64(5), r.Down())
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errc)
+}
+
+// 原来的SecureCopy: 1KiB缓冲区, 每次加密整个缓冲区, 作为基准对比
+func copy1K(dst net.Conn, src net.Conn, secure func(b []byte) error) {
+	buf := make([]byte, 1024)
+	for {
+		nr, er := src.Read(buf)
+		secure(buf)
+		if nr > 0 {
+			_, ew := dst.Write(buf[:nr])
+			if ew != nil {
+				return
+			}
+		}
+		if er != nil {
+			return
+		}
+	}
+}
+
+// 本机TCP连接上单向转发的吞吐量
+// auth不为nil时接收端按加密信道读取, 读到关闭帧结束
+func benchmarkRelay(b *testing.B, auth socks5Auth, run func(left net.Conn, right net.Conn)) {
+	app, left := tcpPair()
+	right, sink := tcpPair()
+	defer app.Close()
+	defer sink.Close()
+	go run(left, right)
+	done := make(chan struct{})
+	go func() {
+		if auth != nil {
+			io.Copy(io.Discard, &cipherConn{Conn: sink, auth: auth})
+		} else {
+			io.Copy(io.Discard, sink)
+		}
+		close(done)
+	}()
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		app.Write(chunk)
+	}
+	app.CloseWrite()
+	<-done
+}
+
+func benchAuth() socks5Auth {
+	auth, err := CreateAuth("random", "abcedfg14")
+	if err != nil {
+		log.Panic(err)
+	}
+	return auth
+}
+
+func BenchmarkCopy1K(b *testing.B) {
+	benchmarkRelay(b, nil, func(left net.Conn, right net.Conn) {
+		copy1K(right, left, func([]byte) error { return nil })
+		right.Close()
+	})
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarkRelay(b, nil, func(left net.Conn, right net.Conn) {
+		(&Relay{Left: left, Right: right}).Run(context.Background())
+	})
+}
+
+func BenchmarkCopy1KEncrypt(b *testing.B) {
+	auth := benchAuth()
+	benchmarkRelay(b, nil, func(left net.Conn, right net.Conn) {
+		copy1K(right, left, auth.Encrypt)
+		right.Close()
+	})
+}
+
+func BenchmarkRelayEncrypt(b *testing.B) {
+	auth := benchAuth()
+	benchmarkRelay(b, auth, func(left net.Conn, right net.Conn) {
+		(&Relay{Left: left, Right: &cipherConn{Conn: right, auth: auth}}).Run(context.Background())
+	})
+}
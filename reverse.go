@@ -0,0 +1,406 @@
+package socks5proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 入站连接等待客户端建立数据信道的超时
+	reverseAcceptTimeout = 10 * time.Second
+	// 控制连接断开后客户端重连的间隔
+	reverseRetryInterval = 5 * time.Second
+	// 入站连接令牌和认证随机数的长度
+	reverseTokenLen = 16
+)
+
+// 反向隧道, 服务端侦听端口, 入站连接通过客户端转发到客户端侧的地址
+//
+// 控制连接:
+//
+//	c->s  请求头, CMD_REVERSE_BIND (DST.PORT为服务端侦听端口, 侦听的IP由服务端配置)
+//	s->c  随机数 nonce
+//	c->s  HMAC-SHA256(用户密码, nonce + port)
+//	s->c  sock5应答, 成功后每个入站连接发送一个16字节令牌
+//
+// 数据信道:
+//
+//	c->s  请求头, CMD_REVERSE_ACCEPT (ATYP=4, DST.ADDR为令牌, 只能由注册的用户取出)
+//	s->c  sock5应答, 之后和普通代理一样加密转发
+//
+// 控制消息都使用writeDatagram的帧格式
+type reverseHub struct {
+	allow    map[int]bool
+	bind     string // 侦听的IP, 为空时侦听所有地址
+	timeouts Timeouts
+	counters *timeoutCounters // 服务端的超时计数
+
+	mu      sync.Mutex
+	pending map[string]reversePending // 令牌 -> 等待数据信道的入站连接
+}
+
+// 等待数据信道的入站连接和注册端口的用户
+type reversePending struct {
+	inbound *net.TCPConn
+	user    string
+}
+
+func newReverseHub(ports []int, bind string, timeouts Timeouts, counters *timeoutCounters) *reverseHub {
+	h := &reverseHub{
+		allow:    make(map[int]bool),
+		bind:     bind,
+		timeouts: timeouts,
+		counters: counters,
+		pending:  make(map[string]reversePending),
+	}
+	for _, port := range ports {
+		h.allow[port] = true
+	}
+	return h
+}
+
+// logger带有连接的用户, 来源和连接ID, rec为入站连接的访问日志记录
+func (h *reverseHub) handleRequest(ctx context.Context, client net.Conn, user *User, request *Socks5Resolution, logger *slog.Logger, rec *AccessRecord) {
+	switch request.CMD {
+	case CMD_REVERSE_BIND:
+		h.handleBind(client, user, request, logger)
+	case CMD_REVERSE_ACCEPT:
+		h.handleAccept(ctx, client, user, request, logger, rec)
+	}
+}
+
+// 控制连接: 认证, 侦听端口, 每个入站连接通过控制连接通知客户端.
+// 只使用请求中的端口, 侦听服务端配置的IP, 客户端不能选择服务端的网卡
+func (h *reverseHub) handleBind(client net.Conn, user *User, request *Socks5Resolution, logger *slog.Logger) {
+	logger = logger.With("bind", request.Addr())
+	auth := user.auth
+	port := int(request.DSTPORT)
+
+	// 认证完成之前仍然限制握手时间, 不让连接占着不发送MAC
+	clearDeadline := h.timeouts.handshakeDeadline(client)
+	nonce := make([]byte, reverseTokenLen)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		logger.Error("create nonce fail", "err", err)
+		return
+	}
+	err = writeDatagram(client, auth, nonce)
+	if err != nil {
+		return
+	}
+	mac := make([]byte, sha256.Size)
+	n, err := readDatagram(client, auth, mac)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(mac[:n], reverseMAC(user.Passwd, nonce, port)) {
+		logger.Warn("auth fail")
+		auth.EncodeWrite(client, BuildReply(REP_NOT_ALLOWED, nil))
+		return
+	}
+	clearDeadline()
+	if !h.allow[port] {
+		logger.Warn("port not allowed", "port", port)
+		auth.EncodeWrite(client, BuildReply(REP_NOT_ALLOWED, nil))
+		return
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(h.bind, strconv.Itoa(port)))
+	if err != nil {
+		logger.Warn("listen fail", "err", err)
+		auth.EncodeWrite(client, BuildReply(REP_FAILURE, nil))
+		return
+	}
+	defer listener.Close()
+	_, err = auth.EncodeWrite(client, BuildReply(REP_SUCCEEDED, listener.Addr()))
+	if err != nil {
+		return
+	}
+	logger.Info("reverse listen", "addr", listener.Addr().String())
+
+	// 控制连接断开时停止侦听
+	if tcp, ok := client.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+	}
+	go func() {
+		io.Copy(io.Discard, client)
+		listener.Close()
+	}()
+
+	for {
+		inbound, err := listener.(*net.TCPListener).AcceptTCP()
+		if err != nil {
+			logger.Info("reverse stop listen", "addr", listener.Addr().String())
+			return
+		}
+
+		token := make([]byte, reverseTokenLen)
+		_, err = rand.Read(token)
+		if err != nil {
+			inbound.Close()
+			continue
+		}
+		h.mu.Lock()
+		h.pending[string(token)] = reversePending{inbound: inbound, user: user.Name}
+		h.mu.Unlock()
+
+		// 客户端没有及时建立数据信道, 丢弃入站连接
+		time.AfterFunc(reverseAcceptTimeout, func() {
+			if h.take(token, user.Name) != nil {
+				logger.Warn("reverse accept timeout", "inbound", inbound.RemoteAddr().String())
+				inbound.Close()
+			}
+		})
+
+		err = writeDatagram(client, auth, token)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 数据信道: 根据令牌取出入站连接, 和客户端之间加密转发
+func (h *reverseHub) handleAccept(ctx context.Context, client net.Conn, user *User, request *Socks5Resolution, logger *slog.Logger, rec *AccessRecord) {
+	auth := user.auth
+	inbound := h.take(request.DSTADDR, user.Name)
+	if inbound == nil || request.ATYP != 0x04 {
+		rec.fail(CLOSE_NOT_ALLOWED, nil)
+		auth.EncodeWrite(client, BuildReply(REP_NOT_ALLOWED, nil))
+		return
+	}
+	defer inbound.Close()
+	// 来源为入站连接, 目标为侦听地址
+	local := inbound.LocalAddr().(*net.TCPAddr)
+	rec.Source = inbound.RemoteAddr().String()
+	rec.Host, rec.IP, rec.Port = local.IP.String(), local.IP.String(), local.Port
+
+	_, err := auth.EncodeWrite(client, BuildReply(REP_SUCCEEDED, nil))
+	if err != nil {
+		rec.fail(CLOSE_ERROR, err)
+		return
+	}
+	logger = logger.With("inbound", inbound.RemoteAddr().String())
+	logger.Info("reverse accept")
+
+	// 反向隧道的入站连接同样限速和计入配额
+	dst := &userConn{Conn: inbound, ctx: ctx, user: user, logger: logger}
+	up, down, err := relay(ctx, &cipherConn{Conn: client, auth: auth}, dst, h.timeouts, h.counters)
+	user.addTraffic(up, down)
+	rec.done(up, down, err)
+	if err != nil {
+		logger.Warn("relay fail", "up", up, "down", down, "err", err)
+	} else {
+		logger.Info("done", "up", up, "down", down)
+	}
+}
+
+// 取出令牌对应的入站连接, 其他用户的令牌不取出, 仍然等待注册的用户
+func (h *reverseHub) take(token []byte, user string) *net.TCPConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.pending[string(token)]
+	if !ok || p.user != user {
+		return nil
+	}
+	delete(h.pending, string(token))
+	return p.inbound
+}
+
+func reverseMAC(passwd string, nonce []byte, port int) []byte {
+	mac := hmac.New(sha256.New, []byte(passwd))
+	mac.Write(nonce)
+	mac.Write([]byte{byte(port >> 8), byte(port)})
+	return mac.Sum(nil)
+}
+
+// 反向隧道, 服务端侦听fwd.ListenAddr的端口, 入站连接转发到客户端侧的fwd.TargetAddr,
+// 服务端可以有多个, 控制连接断开后换下一个服务端. 配置错误时返回错误, ctx结束时关闭隧道并返回ctx.Err()
+func ReverseForward(ctx context.Context, fwd Forward, serverAddrString string, encrytype string, passwd string, opts ForwardOptions) error {
+	if fwd.Network != "tcp" {
+		return fmt.Errorf("reverse forward only support tcp, %v", fwd)
+	}
+	endpoints, err := ParseServerList(serverAddrString, encrytype, passwd)
+	if err != nil {
+		return err
+	}
+	logger := opts.logger(fwd)
+	servers, err := newServerPool(endpoints, POLICY_FAILOVER, 0, logger)
+	if err != nil {
+		return err
+	}
+	defer servers.Close()
+
+	// 控制连接断开后自动重连
+	var node *serverNode
+	for {
+		node = nextReverseNode(servers, node)
+		err = serveReverseForward(ctx, fwd, node, opts, logger)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger.Warn("reverse disconnected", "server", node.Addr, "err", err)
+		node.markDown(servers.backoff)
+
+		timer := time.NewTimer(reverseRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// 优先选择可用的服务端, 都不可用时从上次断开的服务端的下一个开始轮流重试
+func nextReverseNode(servers *ServerPool, last *serverNode) *serverNode {
+	node := servers.candidates()[0]
+	if node != last {
+		return node
+	}
+	for i, n := range servers.nodes {
+		if n == last {
+			return servers.nodes[(i+1)%len(servers.nodes)]
+		}
+	}
+	return node
+}
+
+// logger带有转发定义, ctx结束时关闭控制连接
+func serveReverseForward(ctx context.Context, fwd Forward, node *serverNode, opts ForwardOptions, logger *slog.Logger) error {
+	auth := node.auth
+	timeouts := opts.timeouts()
+	_, portString, err := net.SplitHostPort(fwd.ListenAddr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+	request, err := BuildRequest(CMD_REVERSE_BIND, fwd.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	dialCtx, cancel := timeouts.dialContext(ctx)
+	control, err := connectServer(dialCtx, node.addr)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	stop := context.AfterFunc(ctx, func() { control.Close() })
+	defer stop()
+
+	// 注册端口并认证, 收到应答后清除握手超时
+	clearDeadline := timeouts.handshakeDeadline(control)
+	header, err := BuildHeader(auth, node.Passwd, request)
+	if err != nil {
+		return err
+	}
+	_, err = control.Write(header)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, reverseTokenLen)
+	_, err = readDatagram(control, auth, nonce)
+	if err != nil {
+		return err
+	}
+	err = writeDatagram(control, auth, reverseMAC(node.Passwd, nonce, port))
+	if err != nil {
+		return err
+	}
+	resp, err := ReadReply(control, auth.Decrypt)
+	if err != nil {
+		return err
+	}
+	if resp[1] != REP_SUCCEEDED {
+		return fmt.Errorf("bind rejected, rep=%d", resp[1])
+	}
+	clearDeadline()
+	control.SetKeepAlive(true)
+	logger.Info("reverse registered")
+
+	token := make([]byte, reverseTokenLen)
+	for {
+		n, err := readDatagram(control, auth, token)
+		if err != nil {
+			return err
+		}
+		if n != reverseTokenLen {
+			return fmt.Errorf("bad token length %d", n)
+		}
+
+		accept := []byte{SOCKS_VERSION, CMD_REVERSE_ACCEPT, 0x00, 0x04}
+		accept = append(accept, token...)
+		accept = append(accept, byte(port>>8), byte(port))
+		go handleReverseAccept(ctx, fwd, node, accept, opts, logger)
+	}
+}
+
+// 访问日志的来源为入站连接经过的服务端, ctx结束时中断转发
+func handleReverseAccept(ctx context.Context, fwd Forward, node *serverNode, accept []byte, opts ForwardOptions, logger *slog.Logger) {
+	timeouts := opts.timeouts()
+	id := newConnID()
+	logger = logger.With("conn", id)
+	rec := newForwardRecord(id, node.Addr, fwd.TargetAddr)
+	defer opts.AccessLog.write(rec, logger)
+	dialCtx, cancel := timeouts.dialContext(ctx)
+	localConn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", fwd.TargetAddr)
+	cancel()
+	if err != nil {
+		logger.Error("reverse connect target fail", "err", err)
+		rec.dialFail(err)
+		return
+	}
+	localTarget := localConn.(*net.TCPConn)
+
+	tunnelCtx, cancel := timeouts.tunnelContext(ctx)
+	defer cancel()
+	dstServer, _, err := dialTunnel(withConnID(tunnelCtx, id), node.addr, node.auth, node.Passwd, accept)
+	if err != nil {
+		logger.Error("reverse accept fail", "server", node.Addr, "err", err)
+		rec.dialFail(err)
+		localTarget.Close()
+		return
+	}
+	handleProxyRequest_Proxy(ctx, localTarget, dstServer, node.auth, timeouts, logger, rec)
+}
+
+// 解析端口列表, 例如 "8080,9000-9010"
+func ParsePortList(s string) ([]int, error) {
+	var ports []int
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		lo, hi := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+		start, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("端口错误, %s", item)
+		}
+		end, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("端口错误, %s", item)
+		}
+		for p := start; p <= end; p++ {
+			ports = append(ports, int(p))
+		}
+	}
+	return ports, nil
+}
@@ -0,0 +1,185 @@
+package socks5proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortList(t *testing.T) {
+	ports, err := ParsePortList("8080, 9000-9002,")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{8080, 9000, 9001, 9002}, ports)
+
+	ports, err = ParsePortList("")
+	assert.Nil(t, err)
+	assert.Empty(t, ports)
+
+	for _, s := range []string{"abc", "9002-9000", "70000", "1-"} {
+		_, err = ParsePortList(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	// 客户端侧的服务, 原样返回
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	allowed, denied := closedPort(), closedPort()
+	_, port, _ := net.SplitHostPort(allowed)
+	reversePort, _ := strconv.Atoi(port)
+	dir := t.TempDir()
+	serverLog, err := NewAccessLog(filepath.Join(dir, "server.json"), ACCESS_LOG_JSON, 0, 0)
+	assert.Nil(t, err)
+	defer serverLog.Close()
+	clientLog, err := NewAccessLog(filepath.Join(dir, "client.json"), ACCESS_LOG_JSON, 0, 0)
+	assert.Nil(t, err)
+	defer clientLog.Close()
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg4", ServerOptions: ServerOptions{
+		ReversePorts: []int{reversePort},
+		ReverseBind:  "127.0.0.1",
+		AccessLog:    serverLog,
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	// 服务端只使用请求中的端口, 侦听自己配置的IP
+	go func() {
+		done <- ReverseForward(ctx, Forward{"tcp", "0.0.0.0:" + port, echo.Addr().String()}, serverAddr, "random", "abcedfg4", ForwardOptions{AccessLog: clientLog})
+	}()
+	// 不在允许列表中的端口
+	go ReverseForward(ctx, Forward{"tcp", denied, echo.Addr().String()}, serverAddr, "random", "abcedfg4", ForwardOptions{})
+	waitListen(allowed)
+
+	conn, err := net.Dial("tcp", allowed)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	msg := []byte("hello reverse")
+	_, err = conn.Write(msg)
+	assert.Nil(t, err)
+	resp := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, resp)
+	conn.Close()
+
+	// 服务端记录入站连接, 客户端记录到本地目标的连接, 两边的连接ID相同
+	readRecord := func(path string, key string, value interface{}) map[string]interface{} {
+		var record map[string]interface{}
+		assert.Eventually(t, func() bool {
+			data, _ := os.ReadFile(path)
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var r map[string]interface{}
+				if json.Unmarshal([]byte(line), &r) == nil && r[key] == value {
+					record = r
+					return true
+				}
+			}
+			return false
+		}, 2*time.Second, 10*time.Millisecond)
+		return record
+	}
+	server := readRecord(filepath.Join(dir, "server.json"), "src", conn.LocalAddr().String())
+	assert.Equal(t, float64(reversePort), server["port"])
+	assert.Equal(t, DEFAULT_USER, server["user"])
+	client := readRecord(filepath.Join(dir, "client.json"), "conn", server["conn"])
+	assert.Equal(t, echo.Addr().String(), net.JoinHostPort(client["host"].(string), strconv.Itoa(int(client["port"].(float64)))))
+	assert.Equal(t, float64(len(msg)), client["up"])
+
+	_, err = net.Dial("tcp", denied)
+	assert.NotNil(t, err)
+
+	// 配置错误时返回错误, 不退出进程
+	assert.NotNil(t, ReverseForward(ctx, Forward{"udp", allowed, echo.Addr().String()}, serverAddr, "random", "abcedfg4", ForwardOptions{}))
+	assert.NotNil(t, ReverseForward(ctx, Forward{"tcp", allowed, echo.Addr().String()}, "", "random", "abcedfg4", ForwardOptions{}))
+
+	// ctx结束时关闭控制连接, 服务端停止侦听
+	cancel()
+	select {
+	case err = <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReverseForward did not return")
+	}
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", allowed)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestReverseTokenOwner(t *testing.T) {
+	h := newReverseHub(nil, "", DefaultTimeouts, nil)
+	inbound := &net.TCPConn{}
+	h.pending["token"] = reversePending{inbound: inbound, user: "alice"}
+
+	// 其他用户不能取出入站连接, 令牌仍然留给注册的用户
+	assert.Nil(t, h.take([]byte("token"), "bob"))
+	assert.Equal(t, inbound, h.take([]byte("token"), "alice"))
+	assert.Nil(t, h.take([]byte("token"), "alice"))
+}
+
+func TestReverseBindHandshakeTimeout(t *testing.T) {
+	bind := closedPort()
+	_, port, _ := net.SplitHostPort(bind)
+	reversePort, _ := strconv.Atoi(port)
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg4", ServerOptions: ServerOptions{
+		ReversePorts: []int{reversePort},
+		Timeouts:     &Timeouts{Handshake: 200 * time.Millisecond},
+	}})
+
+	auth, err := CreateAuth("random", "abcedfg4")
+	assert.Nil(t, err)
+	request, err := BuildRequest(CMD_REVERSE_BIND, bind)
+	assert.Nil(t, err)
+	header, err := BuildHeader(auth, "abcedfg4", request)
+	assert.Nil(t, err)
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(header)
+	assert.Nil(t, err)
+	nonce := make([]byte, reverseTokenLen)
+	_, err = readDatagram(conn, auth, nonce)
+	assert.Nil(t, err)
+
+	// 收到随机数后不发送MAC, 握手超时后服务端关闭控制连接
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -1,83 +1,215 @@
 package socks5proxy
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func handleClientRequest(client *net.TCPConn, auth socks5Auth) {
+func (s *ProxyServer) handleClientRequest(client net.Conn) {
+	timeouts := s.timeouts
 	if client == nil {
 		return
 	}
 	defer client.Close()
 
-	// 初始化一个字符串buff
-	buff := make([]byte, 255)
+	// --------------- 识别用户 ----------------
+	// 第一个消息是加密的请求头, 用每个用户的密码尝试解密和校验
+	clearDeadline := timeouts.handshakeDeadline(client)
+	user, request, err := s.users.ReadHeader(client)
+	clearDeadline()
+	if user == nil {
+		countTimeout(&s.timeoutStats.handshake, err)
+		s.logger.Warn("read header fail", "src", client.RemoteAddr().String(), "err", err)
+		return
+	}
+	auth := user.auth
+	logger := s.logger.With("user", user.Name, "src", client.RemoteAddr().String())
+	if request != nil {
+		logger = logger.With("conn", request.ID)
+	}
+	// 访问日志, 反向隧道的控制连接不记录, 入站连接由reverseHub填写来源和侦听地址
+	rec := newAccessRecord(client.RemoteAddr(), request)
+	rec.User = user.Name
+	defer func() {
+		if request == nil || request.CMD != CMD_REVERSE_BIND {
+			s.accessLog.write(rec, logger)
+		}
+	}()
+	if err := user.checkQuota(logger); err != nil {
+		rec.fail(CLOSE_QUOTA, err)
+		return
+	}
+	user.connect()
+	defer user.disconnect()
 
-	// --------------- 认证协商 ----------------
-	var proto ProtocolVersion
-	n, err := auth.DecodeRead(client, buff) //解密
+	//请求头之后的数据留给转发
+	if err != nil {
+		logger.Warn("bad request", "err", err)
+		rec.fail(CLOSE_ERROR, err)
+		auth.EncodeWrite(client, BuildReply(ReplyCode(err), nil))
+		return
+	}
 
-	// handshake
-	resp, err := proto.HandleHandshake(buff[0:n])
+	// 反向隧道由reverseHub自己回应客户端
+	if request.CMD == CMD_REVERSE_BIND || request.CMD == CMD_REVERSE_ACCEPT {
+		s.reverse.handleRequest(s.conns.context(), client, user, request, logger, rec)
+		return
+	}
 
-	// write to client
-	auth.EncodeWrite(client, resp) //加密
+	// 之后每个结束的请求都调用OnClose
+	info := &ConnInfo{ID: request.ID, User: user.Name, Source: client.RemoteAddr(), Target: request.Addr()}
+	// 上游代理解析域名时不在本地解析, 访问控制只按域名和端口检查
+	ctx, cancel := timeouts.dialContext(s.conns.context())
+	if request.CMD != CMD_CONNECT || !s.upstream.remoteDNS(request.DSTDOMAIN) {
+		err = request.resolve(ctx, s.resolver)
+	}
+	cancel()
+	rec.setIP(request)
 	if err != nil {
-		log.Printf("[ERROR] %v, %v", client.RemoteAddr(), err)
+		logger.Warn("resolve fail", "dst", request.Addr(), "err", err)
+		rec.fail(CLOSE_DIAL_FAIL, err)
+		s.hooks.close(info, 0, 0, err)
+		auth.EncodeWrite(client, BuildReply(ReplyCode(err), nil))
+		return
+	}
+
+	// 目标访问控制, 按DNS解析后的地址检查
+	var ip net.IP
+	if request.RAWADDR != nil {
+		ip = request.RAWADDR.IP
+	}
+	if !AllowDestination(user, s.acl, request.DSTDOMAIN, ip, int(request.DSTPORT)) {
+		logger.Warn("destination not allowed", "dst", request.Addr(), "ip", ip)
+		rec.fail(CLOSE_NOT_ALLOWED, nil)
+		s.hooks.close(info, 0, 0, &ReplyError{Rep: REP_NOT_ALLOWED})
+		auth.EncodeWrite(client, BuildReply(REP_NOT_ALLOWED, nil))
 		return
 	}
 
-	//获取客户端代理的请求
-	var request Socks5Resolution
-	n, err = auth.DecodeRead(client, buff)
-	resp, err = request.LSTRequest(buff[0:n])
+	logger = logger.With("dst", request.Addr())
+	logger.Info("connect")
 
-	auth.EncodeWrite(client, resp)
+	err = s.hooks.connect(info)
 	if err != nil {
-		log.Print(client.RemoteAddr(), err)
+		logger.Warn("rejected by hook", "err", err)
+		rec.fail(CLOSE_NOT_ALLOWED, err)
+		s.hooks.close(info, 0, 0, err)
+		auth.EncodeWrite(client, BuildReply(REP_NOT_ALLOWED, nil))
 		return
 	}
 
-	log.Printf("[INFO] %s, %s:%d", client.RemoteAddr().String(), request.DSTDOMAIN, request.DSTPORT)
+	if request.CMD == CMD_UDP_TUNNEL {
+		s.handleUDPTunnel(client, user, request, info, logger, rec)
+		return
+	}
 
-	// 连接真正的远程服务
-	dstServer, err := net.DialTCP("tcp", nil, request.RAWADDR)
+	// 连接真正的远程服务, 连接成功后才回应客户端
+	ctx, cancel = timeouts.dialContext(s.conns.context())
+	dstServer, err := s.dial(ctx, "tcp", request)
+	cancel()
 	if err != nil {
-		log.Printf("------> 连接服务端[%s]失败, %s", request.RAWADDR.String(), err.Error())
+		countTimeout(&s.timeoutStats.dial, err)
+		logger.Warn("dial fail", "ip", ip, "err", err)
+		rec.dialFail(err)
+		s.hooks.close(info, 0, 0, err)
+		auth.EncodeWrite(client, BuildReply(ReplyCode(err), nil))
 		return
 	}
 	defer dstServer.Close()
-	//log.Printf("------> 连接服务端[%s]成功", request.RAWADDR.String())
+	_, err = auth.EncodeWrite(client, BuildReply(REP_SUCCEEDED, dstServer.LocalAddr()))
+	if err != nil {
+		rec.fail(CLOSE_ERROR, err)
+		s.hooks.close(info, 0, 0, err)
+		return
+	}
 
-	wg := new(sync.WaitGroup)
-	wg.Add(2)
+	// 限速和流量配额, 配额用完时关闭两端
+	dst := &userConn{Conn: dstServer, ctx: s.conns.context(), user: user, logger: logger}
+	tunnel := &cipherConn{Conn: client, auth: auth}
+	up, down, err := relay(s.conns.context(), tunnel, dst, timeouts, &s.timeoutStats)
+	user.addTraffic(up, down)
+	s.hooks.close(info, up, down, err)
+	rec.done(up, down, err)
+	if err != nil {
+		logger.Warn("relay fail", "up", up, "down", down, "err", err)
+	} else {
+		logger.Info("done", "up", up, "down", down)
+	}
+}
 
-	// 本地的内容copy到远程端
-	go func() {
-		defer wg.Done()
-		n, err := SecureCopy(client, dstServer, auth.Decrypt)
-		if err != nil {
-			log.Printf("[WARN] c->s, send fail, %v", err)
-		} else {
-			log.Printf("[INFo] c->s, %s:%d,len=%s", request.DSTDOMAIN, request.DSTPORT, Len2Str(n))
-		}
+// UDP over TCP, 客户端发来的数据报转发到目标地址, 目标的回包原路返回
+func (s *ProxyServer) handleUDPTunnel(client net.Conn, user *User, request *Socks5Resolution, info *ConnInfo, logger *slog.Logger, rec *AccessRecord) {
+	auth := user.auth
+	ctx, cancel := s.timeouts.dialContext(s.conns.context())
+	dstServer, err := s.dial(ctx, "udp", request)
+	cancel()
+	if err != nil {
+		logger.Warn("udp dial fail", "ip", request.RAWADDR.IP, "err", err)
+		rec.dialFail(err)
+		s.hooks.close(info, 0, 0, err)
+		auth.EncodeWrite(client, BuildReply(ReplyCode(err), nil))
+		return
+	}
+	defer dstServer.Close()
+	_, err = auth.EncodeWrite(client, BuildReply(REP_SUCCEEDED, dstServer.LocalAddr()))
+	if err != nil {
+		rec.fail(CLOSE_ERROR, err)
+		s.hooks.close(info, 0, 0, err)
+		return
+	}
+	var up, down int64
+	defer func() {
+		s.hooks.close(info, atomic.LoadInt64(&up), atomic.LoadInt64(&down), nil)
+		rec.done(atomic.LoadInt64(&up), atomic.LoadInt64(&down), nil)
 	}()
 
-	// 远程得到的内容copy到源地址
+	// 本地的数据报发往远程端
 	go func() {
-		defer wg.Done()
-		n, err := SecureCopy(dstServer, client, auth.Encrypt)
-		if err != nil {
-			log.Printf("[WARN] s->c, send fail, %v", err)
-		} else {
-			log.Printf("[INFo] s->c, %s:%d,len=%s", request.DSTDOMAIN, request.DSTPORT, Len2Str(n))
+		defer dstServer.Close()
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			n, err := readDatagram(client, auth, buf)
+			if err != nil || user.checkQuota(logger) != nil {
+				return
+			}
+			if user.waitUp(s.conns.context(), n) != nil {
+				return
+			}
+			dstServer.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			dstServer.Write(buf[:n])
+			user.charge(n)
+			user.addTraffic(int64(n), 0)
+			atomic.AddInt64(&up, int64(n))
 		}
 	}()
-	wg.Wait()
 
+	// 远程得到的数据报发回源地址
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		dstServer.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := dstServer.Read(buf)
+		if err != nil || user.checkQuota(logger) != nil {
+			return
+		}
+		user.charge(n)
+		if user.waitDown(s.conns.context(), n) != nil {
+			return
+		}
+		err = writeDatagram(client, auth, buf[:n])
+		if err != nil {
+			logger.Warn("udp send fail", "err", err)
+			return
+		}
+		user.addTraffic(0, int64(n))
+		atomic.AddInt64(&down, int64(n))
+	}
 }
 
 func Len2Str(n int64) string {
@@ -96,32 +228,179 @@ func Len2Str(n int64) string {
 	return s
 }
 
+// 服务端可选配置
+type ServerOptions struct {
+	ReversePorts []int           // 允许客户端注册反向隧道的端口, 为空时不开放反向隧道
+	ReverseBind  string          // 反向隧道侦听的IP, 为空时侦听所有地址. 客户端请求中的地址只使用端口
+	Upstream     *UpstreamRouter // 出站连接经过的上游代理, 为空时直连
+	Users        *UserDB         // 多用户, 为空时只有一个使用passwd的用户. Shutdown时关闭
+	AdminAddr    string          // 管理接口地址, 为空时不开启
+	UploadRate   int64           // 所有用户共用的上传速度, 字节/秒, 0为不限制
+	DownloadRate int64           // 所有用户共用的下载速度, 字节/秒, 0为不限制
+	QuotaFile    string          // 流量计数文件, 为空时重启后配额重新计算
+	ACL          *ACL            // 目标访问控制规则, 没有匹配的规则时禁止访问内网地址
+	Timeouts     *Timeouts       // 超时设置, 为空时使用DefaultTimeouts
+	Resolver     *net.Resolver   // 解析目标域名的DNS, 为空时使用系统设置, 见NewResolver
+	AccessLog    *AccessLog      // 每个结束的代理连接一条记录, 为空时不记录
+}
+
 func Server(listenAddrString string, encrytype string, passwd string) {
-	//所有客户服务端的流都加密,
-	auth, err := CreateAuth(encrytype, passwd)
+	ServerWithOptions(listenAddrString, encrytype, passwd, ServerOptions{})
+}
+
+func ServerWithOptions(listenAddrString string, encrytype string, passwd string, opts ServerOptions) {
+	server, err := NewProxyServer(ServerConfig{
+		ListenAddr:    listenAddrString,
+		EncryType:     encrytype,
+		Passwd:        passwd,
+		ServerOptions: opts,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	//log.Printf("你的密码是:%s ,请保管好你的密码", passwd)
+	log.Fatal(server.ListenAndServe())
+}
 
-	// 监听客户端
-	listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrString)
-	if err != nil {
-		log.Fatal(err)
+// 嵌入使用的服务端配置
+type ServerConfig struct {
+	ListenAddr string // ListenAndServe侦听的地址
+	EncryType  string // 没有Users时唯一用户的加密类型和密码
+	Passwd     string
+	ServerOptions
+
+	Logger *slog.Logger // 为空时使用slog.Default()
+	Dialer NetDialer    // 直连目标(没有上游代理或者上游规则为直连)使用的拨号器, 连接ACL检查过的IP, 为空时使用net.Dialer
+	Hooks  Hooks
+}
+
+// 可以嵌入和优雅关闭的服务端
+type ProxyServer struct {
+	listenAddr string
+	users      *UserDB
+	reverse    *reverseHub
+	upstream   *UpstreamRouter
+	dialer     NetDialer
+	resolver   *net.Resolver
+	acl        *ACL
+	timeouts   Timeouts
+	quotaFile  string
+	accessLog  *AccessLog
+	logger     *slog.Logger
+	hooks      Hooks
+
+	admin     *http.Server
+	adminOnce sync.Once
+	conns     connTracker
+
+	timeoutStats timeoutCounters
+}
+
+func NewProxyServer(cfg ServerConfig) (*ProxyServer, error) {
+	//所有客户服务端的流都加密, 每个用户有自己的密码
+	users := cfg.Users
+	if users == nil {
+		var err error
+		users, err = NewStaticUserDB(cfg.EncryType, cfg.Passwd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	users.setLogger(logger)
+	users.SetGlobalRateLimit(cfg.UploadRate, cfg.DownloadRate)
+	if len(cfg.QuotaFile) > 0 {
+		err := users.PersistQuota(cfg.QuotaFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timeouts := DefaultTimeouts
+	if cfg.Timeouts != nil {
+		timeouts = *cfg.Timeouts
+	}
+	dialer := cfg.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
 	}
-	log.Printf("[INFO] listen port: %s", listenAddrString)
+	s := &ProxyServer{
+		listenAddr: cfg.ListenAddr,
+		users:      users,
+		upstream:   cfg.Upstream,
+		dialer:     dialer,
+		resolver:   cfg.Resolver,
+		acl:        cfg.ACL,
+		timeouts:   timeouts,
+		quotaFile:  cfg.QuotaFile,
+		accessLog:  cfg.AccessLog,
+		logger:     logger,
+		hooks:      cfg.Hooks,
+	}
+	s.reverse = newReverseHub(cfg.ReversePorts, cfg.ReverseBind, timeouts, &s.timeoutStats)
+	if len(cfg.AdminAddr) > 0 {
+		s.admin = &http.Server{Addr: cfg.AdminAddr, Handler: serverAdminHandler(users, &s.timeoutStats), ErrorLog: errorLog(logger)}
+	}
+	return s, nil
+}
 
-	listener, err := net.ListenTCP("tcp", listenAddr)
+// 这个服务端各种超时发生的次数
+func (s *ProxyServer) TimeoutStats() TimeoutStatus {
+	return s.timeoutStats.status()
+}
+
+// 连接请求的目标, 有上游代理时经过上游代理, 上游规则为直连时使用ServerConfig.Dialer
+func (s *ProxyServer) dial(ctx context.Context, network string, request *Socks5Resolution) (net.Conn, error) {
+	if s.upstream != nil && network == "tcp" {
+		return s.upstream.dialRequest(ctx, request, s.dialer)
+	}
+	return s.dialer.DialContext(ctx, network, request.RAWADDR.String())
+}
+
+// 侦听ServerConfig.ListenAddr并处理客户端连接, 使用自己的listener时调用Serve
+func (s *ProxyServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.listenAddr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer listener.Close()
+	s.logger.Info("listen", "addr", listener.Addr().String())
+	return s.Serve(listener)
+}
 
-	for {
-		conn, err := listener.AcceptTCP()
-		if err != nil {
-			log.Fatal(err)
+// 处理listener上的客户端连接, 直到listener出错或者Shutdown, Shutdown之后返回ErrServerClosed.
+// 第一次调用时启动管理接口
+func (s *ProxyServer) Serve(listener net.Listener) error {
+	s.adminOnce.Do(s.startAdmin)
+	return s.conns.serve(listener, s.logger, s.handleClientRequest)
+}
+
+func (s *ProxyServer) startAdmin() {
+	if s.admin == nil {
+		return
+	}
+	go func() {
+		s.logger.Info("admin listen", "addr", s.admin.Addr)
+		err := s.admin.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Error("admin server fail", "err", err)
+		}
+	}()
+}
+
+// 停止接受新连接, 等待正在转发的连接结束, ctx结束时强制关闭剩下的连接并返回ctx.Err().
+// 关闭后停止用户库的后台任务并写回流量计数
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	err := s.conns.shutdown(ctx, s.logger)
+	s.users.Close()
+	if len(s.quotaFile) > 0 {
+		if err := s.users.saveQuota(s.quotaFile); err != nil {
+			s.logger.Error("save quota fail", "err", err)
 		}
-		go handleClientRequest(conn, auth)
 	}
+	return err
 }
@@ -0,0 +1,354 @@
+package socks5proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 服务端选择策略
+const (
+	POLICY_FAILOVER    = "failover"    // 按顺序使用第一个可用的服务端
+	POLICY_ROUND_ROBIN = "round-robin" // 轮询
+	POLICY_LEAST_CONN  = "least-conn"  // 当前连接数最少
+	POLICY_LATENCY     = "latency"     // 握手延迟最低
+)
+
+const (
+	// 服务端失败后的初始退避时间, 连续失败时翻倍
+	defaultServerBackoff = 10 * time.Second
+	maxServerBackoff     = 5 * time.Minute
+	// 后台检查不可用服务端的间隔
+	serverRecoverInterval = 1 * time.Second
+	// 延迟指数加权平均的权重
+	latencyEWMAWeight = 0.3
+)
+
+// 服务端节点, 每个节点有自己的加密方法和密码
+type ServerEndpoint struct {
+	Addr      string
+	EncryType string
+	Passwd    string
+	FastOpen  bool // 分享链接要求0-RTT, 只对这个服务端有效
+}
+
+func (e ServerEndpoint) String() string {
+	return e.Addr
+}
+
+// 解析服务端列表, 多个服务端用","分隔, 每项为 "host:port", "type:passwd@host:port" 或者分享链接
+// "sckpy://...", 没有指定加密方法和密码时使用默认值
+func ParseServerList(spec string, encrytype string, passwd string) ([]ServerEndpoint, error) {
+	var endpoints []ServerEndpoint
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if strings.HasPrefix(item, SHARE_SCHEME+"://") {
+			l, err := ParseShareLink(item)
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, ServerEndpoint{Addr: l.Addr, EncryType: l.EncryType, Passwd: l.Passwd, FastOpen: l.FastOpen})
+			continue
+		}
+		e := ServerEndpoint{Addr: item, EncryType: encrytype, Passwd: passwd}
+		if i := strings.LastIndex(item, "@"); i >= 0 {
+			e.Addr = item[i+1:]
+			cred := item[:i]
+			j := strings.Index(cred, ":")
+			if j < 0 {
+				return nil, fmt.Errorf("服务端格式错误, %s", item)
+			}
+			e.EncryType, e.Passwd = cred[:j], cred[j+1:]
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("请输入服务器地址")
+	}
+	return endpoints, nil
+}
+
+type serverNode struct {
+	ServerEndpoint
+	addr   *net.TCPAddr
+	auth   socks5Auth
+	logger *slog.Logger
+
+	active int64 // 当前连接数, 原子操作
+
+	mu        sync.Mutex
+	down      bool
+	failures  int
+	downUntil time.Time
+	latency   time.Duration
+
+	// 健康检查结果
+	probes      int
+	successRate float64
+	lastCheck   time.Time
+	lastErr     string
+}
+
+func (n *serverNode) isDown() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.down
+}
+
+func (n *serverNode) getLatency() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency
+}
+
+// 标记不可用, 退避时间随连续失败次数翻倍
+func (n *serverNode) markDown(backoff time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failures++
+	shift := n.failures - 1
+	if shift > 5 {
+		shift = 5
+	}
+	wait := backoff << uint(shift)
+	if wait > maxServerBackoff {
+		wait = maxServerBackoff
+	}
+	n.downUntil = time.Now().Add(wait)
+	if !n.down {
+		n.logger.Warn("server down", "server", n.Addr, "retry", wait)
+	}
+	n.down = true
+}
+
+func (n *serverNode) markUp(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down {
+		n.logger.Info("server up", "server", n.Addr)
+	}
+	n.down = false
+	n.failures = 0
+	if n.latency == 0 {
+		n.latency = latency
+	} else {
+		n.latency = time.Duration(latencyEWMAWeight*float64(latency) + (1-latencyEWMAWeight)*float64(n.latency))
+	}
+}
+
+// 服务端池, 按策略选择服务端, 失败的服务端在退避时间后由后台重试
+type ServerPool struct {
+	nodes   []*serverNode
+	policy  string
+	backoff time.Duration
+	next    uint32
+
+	checking int32 // 启用健康检查后由健康检查负责恢复服务端
+
+	logger *slog.Logger
+	bg     background
+}
+
+func NewServerPool(endpoints []ServerEndpoint, policy string, backoff time.Duration) (*ServerPool, error) {
+	return newServerPool(endpoints, policy, backoff, slog.Default())
+}
+
+// 客户端和端口转发使用自己的logger
+func newServerPool(endpoints []ServerEndpoint, policy string, backoff time.Duration, logger *slog.Logger) (*ServerPool, error) {
+	p, err := parseServerPool(endpoints, policy, backoff, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.nodes) > 1 {
+		p.bg.start(p.recoverLoop)
+	}
+	return p, nil
+}
+
+// 检查配置并创建服务端池, 不启动后台恢复
+func parseServerPool(endpoints []ServerEndpoint, policy string, backoff time.Duration, logger *slog.Logger) (*ServerPool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("请输入服务器地址")
+	}
+	switch policy {
+	case "":
+		policy = POLICY_FAILOVER
+	case POLICY_FAILOVER, POLICY_ROUND_ROBIN, POLICY_LEAST_CONN, POLICY_LATENCY:
+	default:
+		return nil, fmt.Errorf("错误的服务端选择策略, %s", policy)
+	}
+	if backoff <= 0 {
+		backoff = defaultServerBackoff
+	}
+
+	p := &ServerPool{policy: policy, backoff: backoff, logger: logger}
+	for _, e := range endpoints {
+		auth, err := CreateAuth(e.EncryType, e.Passwd)
+		if err != nil {
+			return nil, fmt.Errorf("%s, %v", e.Addr, err)
+		}
+		addr, err := net.ResolveTCPAddr("tcp", e.Addr)
+		if err != nil {
+			return nil, err
+		}
+		p.nodes = append(p.nodes, &serverNode{ServerEndpoint: e, addr: addr, auth: auth, logger: logger})
+	}
+	return p, nil
+}
+
+// 按策略排列可用的服务端, 全部不可用时按原顺序尝试所有服务端
+func (p *ServerPool) candidates() []*serverNode {
+	var up []*serverNode
+	for _, n := range p.nodes {
+		if !n.isDown() {
+			up = append(up, n)
+		}
+	}
+	if len(up) == 0 {
+		return p.nodes
+	}
+
+	switch p.policy {
+	case POLICY_ROUND_ROBIN:
+		i := int(atomic.AddUint32(&p.next, 1)-1) % len(up)
+		up = append(up[i:], up[:i]...)
+	case POLICY_LEAST_CONN:
+		sort.SliceStable(up, func(i, j int) bool {
+			return atomic.LoadInt64(&up[i].active) < atomic.LoadInt64(&up[j].active)
+		})
+	case POLICY_LATENCY:
+		sort.SliceStable(up, func(i, j int) bool {
+			return up[i].getLatency() < up[j].getLatency()
+		})
+	}
+	return up
+}
+
+// 依次尝试服务端直到建立加密信道, 连接关闭后需要调用release.
+// 只有连不上服务端时才标记不可用, 发送请求后的超时可能是目标响应慢, 不切换服务端.
+// 所有尝试共用ctx的期限, 调用者的ctx结束后不再尝试
+func (p *ServerPool) dialTunnel(ctx context.Context, request []byte) (*net.TCPConn, *serverNode, net.Addr, error) {
+	return p.dialServer(ctx, request, false)
+}
+
+// 同dialTunnel, fastOpen为true或者服务端要求0-RTT时只建立TCP连接, 请求头由fastOpenConn和第一段数据一起发送
+func (p *ServerPool) dialServer(ctx context.Context, request []byte, fastOpen bool) (*net.TCPConn, *serverNode, net.Addr, error) {
+	err := errors.New("no server available")
+	budget := attemptBudget(ctx)
+	if budget <= 0 {
+		return nil, nil, nil, context.DeadlineExceeded
+	}
+	for _, node := range p.candidates() {
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		conn, bind, timeout, attemptErr := p.dialNode(ctx, budget, node, request, fastOpen || node.FastOpen)
+		if attemptErr == nil {
+			atomic.AddInt64(&node.active, 1)
+			return conn, node, bind, nil
+		}
+		err = attemptErr
+		if _, ok := err.(*ReplyError); ok || timeout || ctx.Err() != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return nil, nil, nil, err
+}
+
+// 尝试一个服务端, 最多用budget, 不超过调用者剩余的时间. timeout表示请求已发送后超时.
+// fastOpen时连上服务端就返回, 不发送请求头
+func (p *ServerPool) dialNode(parent context.Context, budget time.Duration, node *serverNode, request []byte, fastOpen bool) (*net.TCPConn, net.Addr, bool, error) {
+	ctx, cancel := context.WithTimeout(parent, budget)
+	defer cancel()
+	id := connIDFrom(ctx)
+	header, err := buildHeader(node.auth, node.Passwd, request, id)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	start := time.Now()
+	conn, err := connectServer(ctx, node.addr)
+	if err != nil {
+		if parent.Err() != context.Canceled {
+			p.logger.Warn("server dial fail", "conn", id, "server", node.Addr, "err", err)
+			node.markDown(p.backoff)
+		}
+		return nil, nil, false, err
+	}
+	if fastOpen {
+		node.markUp(time.Since(start))
+		return conn, nil, false, nil
+	}
+	tunnel, bind, err := handshakeTunnel(ctx, conn, node.auth, header)
+	if _, ok := err.(*ReplyError); ok || err == nil {
+		// 服务端正常应答, 只是连不上目标时也不切换服务端
+		node.markUp(time.Since(start))
+		return tunnel, bind, false, err
+	}
+	p.logger.Warn("server handshake fail", "conn", id, "server", node.Addr, "err", err)
+	// 没有应答就断开一般是密码或者加密方法不对, 换下一个服务端
+	if isServerReject(err) {
+		node.markDown(p.backoff)
+	}
+	// 连接的deadline可能比ctx的计时器先到, 两者都算超时
+	return nil, nil, ctx.Err() != nil || isTimeout(err), err
+}
+
+// 服务端收到请求头后没有应答就关闭连接
+func isServerReject(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// 每个服务端的尝试时间, 没有超时时使用默认的连接超时
+func attemptBudget(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return DefaultTimeouts.Dial
+}
+
+func (p *ServerPool) release(node *serverNode) {
+	atomic.AddInt64(&node.active, -1)
+}
+
+// 停止后台恢复和健康检查, 等待正在进行的检查结束
+func (p *ServerPool) Close() {
+	p.bg.close()
+}
+
+// 后台重试退避时间已到的服务端, 能建立TCP连接就重新启用
+func (p *ServerPool) recoverLoop(stop <-chan struct{}) {
+	for sleepOrStop(stop, serverRecoverInterval) {
+		if atomic.LoadInt32(&p.checking) == 1 {
+			continue
+		}
+		for _, n := range p.nodes {
+			n.mu.Lock()
+			due := n.down && time.Now().After(n.downUntil)
+			n.mu.Unlock()
+			if !due {
+				continue
+			}
+
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", n.addr.String(), p.backoff)
+			if err != nil {
+				n.markDown(p.backoff)
+				continue
+			}
+			conn.Close()
+			n.markUp(time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServerList(t *testing.T) {
+	endpoints, err := ParseServerList("1.1.1.1:80, simple:p@ss@2.2.2.2:81", "random", "123456")
+	assert.Nil(t, err)
+	assert.Equal(t, []ServerEndpoint{
+		{"1.1.1.1:80", "random", "123456", false},
+		{"2.2.2.2:81", "simple", "p@ss", false},
+	}, endpoints)
+
+	_, err = ParseServerList("", "random", "123456")
+	assert.NotNil(t, err)
+	_, err = ParseServerList("nopasswd@1.1.1.1:80", "random", "123456")
+	assert.NotNil(t, err)
+}
+
+func TestServerPoolPolicy(t *testing.T) {
+	endpoints := []ServerEndpoint{
+		{"127.0.0.1:1", "random", "a", false},
+		{"127.0.0.1:2", "random", "b", false},
+		{"127.0.0.1:3", "random", "c", false},
+	}
+
+	_, err := NewServerPool(endpoints, "random", 0)
+	assert.NotNil(t, err)
+
+	// 轮询
+	pool, err := NewServerPool(endpoints, POLICY_ROUND_ROBIN, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:1", pool.candidates()[0].Addr)
+	assert.Equal(t, "127.0.0.1:2", pool.candidates()[0].Addr)
+	assert.Equal(t, "127.0.0.1:3", pool.candidates()[0].Addr)
+
+	// 不可用的服务端不参与选择
+	pool.nodes[1].markDown(pool.backoff)
+	for i := 0; i < 4; i++ {
+		assert.Len(t, pool.candidates(), 2)
+		assert.NotEqual(t, "127.0.0.1:2", pool.candidates()[0].Addr)
+	}
+
+	// 最少连接
+	pool, _ = NewServerPool(endpoints, POLICY_LEAST_CONN, time.Minute)
+	pool.nodes[0].active = 3
+	pool.nodes[1].active = 1
+	pool.nodes[2].active = 2
+	assert.Equal(t, "127.0.0.1:2", pool.candidates()[0].Addr)
+
+	// 最低延迟
+	pool, _ = NewServerPool(endpoints, POLICY_LATENCY, time.Minute)
+	pool.nodes[0].markUp(30 * time.Millisecond)
+	pool.nodes[1].markUp(20 * time.Millisecond)
+	pool.nodes[2].markUp(10 * time.Millisecond)
+	assert.Equal(t, "127.0.0.1:3", pool.candidates()[0].Addr)
+}
+
+func TestServerFailover(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// 第一个服务端不存在, 第二个服务端使用不同的密码
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "simple", Passwd: "other", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	listen := closedPort()
+	go LocalForward(context.Background(), Forward{"tcp", listen, echo.Addr().String()}, closedPort()+",simple:other@"+serverAddr, "random", "abcedfg5", ForwardOptions{})
+	waitListen(listen)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		msg := []byte("hello failover")
+		_, err = conn.Write(msg)
+		assert.Nil(t, err)
+		resp := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(conn, resp)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, resp)
+		conn.Close()
+	}
+}
+
+func TestServerPoolDialTimeout(t *testing.T) {
+	// 接受连接但不应答, 相当于服务端连接目标很慢
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer slow.Close()
+	go func() {
+		for {
+			conn, err := slow.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool, err := NewServerPool([]ServerEndpoint{
+		{closedPort(), "random", "a", false},
+		{slow.Addr().String(), "random", "b", false},
+		{slow.Addr().String(), "random", "c", false},
+	}, POLICY_FAILOVER, time.Minute)
+	assert.Nil(t, err)
+	request, _ := BuildRequest(CMD_CONNECT, "127.0.0.1:80")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, _, err = pool.dialTunnel(ctx, request)
+	assert.True(t, isTimeout(err), err)
+	assert.Equal(t, byte(REP_TTL_EXPIRED), ReplyCode(err))
+	// 连不上的服务端标记不可用
+	assert.True(t, pool.nodes[0].isDown())
+	// 发送请求后超时不标记不可用, 也不再尝试其他服务端
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 300*time.Millisecond && elapsed < 600*time.Millisecond, elapsed)
+	assert.False(t, pool.nodes[1].isDown())
+	assert.False(t, pool.nodes[2].isDown())
+
+	// 调用者的超时在第一个服务端已经用完时不再尝试
+	expired, cancel2 := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel2()
+	_, _, _, err = pool.dialTunnel(expired, request)
+	assert.True(t, isTimeout(err))
+	assert.False(t, pool.nodes[1].isDown())
+}
+
+func TestServerPoolDeadline(t *testing.T) {
+	// 收到请求头后过一会儿才断开, 相当于密码不对的服务端
+	reject, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer reject.Close()
+	go func() {
+		for {
+			conn, err := reject.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				conn.Close()
+			}()
+		}
+	}()
+
+	endpoints := []ServerEndpoint{
+		{reject.Addr().String(), "random", "a", false},
+		{reject.Addr().String(), "random", "b", false},
+		{reject.Addr().String(), "random", "c", false},
+	}
+	pool, err := NewServerPool(endpoints, POLICY_FAILOVER, time.Minute)
+	assert.Nil(t, err)
+	defer pool.Close()
+	request, _ := BuildRequest(CMD_CONNECT, "127.0.0.1:80")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, _, err = pool.dialTunnel(ctx, request)
+	assert.NotNil(t, err)
+	// 所有尝试一共不超过调用者的期限
+	elapsed := time.Since(start)
+	assert.True(t, elapsed < 450*time.Millisecond, elapsed)
+	// 没有应答就断开的服务端标记不可用
+	assert.True(t, pool.nodes[0].isDown())
+	assert.False(t, pool.nodes[2].isDown())
+}
@@ -0,0 +1,70 @@
+package socks5proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareLink(t *testing.T) {
+	for _, l := range []ShareLink{
+		{EncryType: "random", Passwd: "123456", Addr: "1.2.3.4:18888"},
+		{EncryType: "simple", Passwd: "p:a@s/s#w?d", Addr: "[2001:db8::1]:443", FastOpen: true, Remark: "香港 01, alice"},
+		{EncryType: "random", Passwd: "", Addr: "proxy.example.com:18888", Remark: "a/b#c%d"},
+	} {
+		s := l.String()
+		assert.True(t, strings.HasPrefix(s, "sckpy://"), s)
+		// 多个链接可以用","分隔
+		assert.NotContains(t, s, ",")
+		parsed, err := ParseShareLink(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, l, parsed)
+	}
+
+	// 带填充的base64, 没有"/"
+	l, err := ParseShareLink("sckpy://cmFuZG9tOjEyMzQ1Ng==@1.2.3.4:18888#x")
+	assert.Nil(t, err)
+	assert.Equal(t, ShareLink{EncryType: "random", Passwd: "123456", Addr: "1.2.3.4:18888", Remark: "x"}, l)
+
+	for _, s := range []string{
+		"ss://cmFuZG9tOjEyMzQ1Ng@1.2.3.4:18888",
+		"sckpy://1.2.3.4:18888",
+		"sckpy://!!!@1.2.3.4:18888",
+		"sckpy://MTIzNDU2@1.2.3.4:18888",
+		"sckpy://cmFuZG9tOjEyMzQ1Ng@1.2.3.4",
+		"sckpy://cmFuZG9tOjEyMzQ1Ng@1.2.3.4:18888/?fast_open=yes",
+	} {
+		_, err := ParseShareLink(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestShareLinkServerList(t *testing.T) {
+	links := []string{
+		ShareLink{EncryType: "simple", Passwd: "s3cret", Addr: "1.1.1.1:1", Remark: "a,b"}.String(),
+		ShareLink{EncryType: "random", Passwd: "pw", Addr: "2.2.2.2:2", FastOpen: true}.String(),
+	}
+	spec := strings.Join(links, ",") + ",3.3.3.3:3"
+	endpoints, err := ParseServerList(spec, "random", "default")
+	assert.Nil(t, err)
+	assert.Equal(t, []ServerEndpoint{
+		{Addr: "1.1.1.1:1", EncryType: "simple", Passwd: "s3cret"},
+		{Addr: "2.2.2.2:2", EncryType: "random", Passwd: "pw", FastOpen: true},
+		{Addr: "3.3.3.3:3", EncryType: "random", Passwd: "default"},
+	}, endpoints)
+
+	_, err = ParseServerList("sckpy://bad", "random", "default")
+	assert.NotNil(t, err)
+
+	// 每个用户一个链接, 备注为用户名
+	db, err := ParseUserDB([]string{"alice random s3cret", "bob simple passw0rd"})
+	assert.Nil(t, err)
+	shared := db.ShareLinks("proxy.example.com:18888", false)
+	assert.Equal(t, 2, len(shared))
+	for _, l := range shared {
+		parsed, err := ParseShareLink(l.String())
+		assert.Nil(t, err)
+		assert.Equal(t, l, parsed)
+	}
+}
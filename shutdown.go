@@ -0,0 +1,211 @@
+package socks5proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Shutdown之后Serve返回的错误
+var ErrServerClosed = errors.New("服务已关闭")
+
+// 正在侦听的listener和正在处理的连接, 用于优雅关闭:
+// 先停止侦听, 等待已有连接结束, 超过期限后强制关闭剩下的连接
+type connTracker struct {
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+
+	// 强制关闭时取消, 转发中的连接用它关闭目标一端
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (t *connTracker) initContext() {
+	if t.ctx == nil {
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// 处理函数转发时使用的ctx, 强制关闭时取消
+func (t *connTracker) context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.initContext()
+	return t.ctx
+}
+
+func (t *connTracker) addListener(l net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.listeners == nil {
+		t.listeners = make(map[net.Listener]struct{})
+	}
+	t.listeners[l] = struct{}{}
+	return true
+}
+
+func (t *connTracker) removeListener(l net.Listener) {
+	t.mu.Lock()
+	delete(t.listeners, l)
+	t.mu.Unlock()
+}
+
+func (t *connTracker) add(c net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) done(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+func (t *connTracker) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// 接受连接并在新的goroutine中处理, 直到listener出错或者Shutdown.
+// 临时错误(例如文件描述符用完)等待一段时间后重试
+func (t *connTracker) serve(l net.Listener, logger *slog.Logger, handle func(conn net.Conn)) error {
+	if !t.addListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer t.removeListener(l)
+	defer l.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Error("accept fail", "err", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !t.add(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer t.done(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// 停止侦听并等待连接结束, ctx结束时强制关闭剩下的连接并返回ctx.Err()
+func (t *connTracker) shutdown(ctx context.Context, logger *slog.Logger) error {
+	t.mu.Lock()
+	t.closed = true
+	for l := range t.listeners {
+		l.Close()
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	logger.Warn("shutdown, force close connections", "count", len(t.conns))
+	for c := range t.conns {
+		c.Close()
+	}
+	t.initContext()
+	t.cancel()
+	t.mu.Unlock()
+	// 连接关闭后处理函数很快返回, 等它们结束后才算关闭完成
+	<-done
+	return ctx.Err()
+}
+
+// 后台任务, 关闭时通知所有任务退出并等待它们结束
+type background struct {
+	mu     sync.Mutex
+	stop   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// 在新的goroutine中运行f, stop关闭时f应该尽快返回. 已经关闭时不运行
+func (b *background) start(f func(stop <-chan struct{})) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	if b.stop == nil {
+		b.stop = make(chan struct{})
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f(b.stop)
+	}()
+}
+
+// 通知后台任务退出并等待, 可以多次调用
+func (b *background) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		if b.stop != nil {
+			close(b.stop)
+		}
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// 等待d, 期间stop关闭时返回false
+func sleepOrStop(stop <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
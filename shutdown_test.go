@@ -0,0 +1,222 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在随机端口上启动客户端, 返回侦听地址和Serve的返回值
+func serveTestClient(serverAddr string, passwd string) (*ProxyClient, string, chan error) {
+	client, err := NewProxyClient(ClientConfig{
+		ServerAddr:    serverAddr,
+		EncryType:     "random",
+		Passwd:        passwd,
+		RecvHTTPProto: "sock5",
+		ClientOptions: ClientOptions{Rules: []string{"127.0.0.1=" + OUTBOUND_PROXY}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Serve(l)
+	}()
+	return client, l.Addr().String(), done
+}
+
+// 在随机端口上启动服务端, 测试结束时关闭, 返回侦听地址
+func startTestServer(t *testing.T, cfg ServerConfig) string {
+	server, err := NewProxyServer(cfg)
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	t.Cleanup(func() {
+		// 测试留下的连接强制关闭
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		server.Shutdown(ctx)
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// 在随机端口上启动客户端, 测试结束时关闭, 返回侦听地址
+func startTestClient(t *testing.T, cfg ClientConfig) string {
+	client, err := NewProxyClient(cfg)
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Serve(l)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		client.Shutdown(ctx)
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// 等待端口转发等在后台侦听的地址可以连接
+func waitListen(addr string) {
+	for i := 0; i < 200; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Panicf("%s 没有侦听", addr)
+}
+
+// 经过本地sock5连接目标, 返回连接和应答码
+func dialSocks5(proxyAddr string, target string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{SOCKS_VERSION, 0x01, METHOD_CODE})
+	io.ReadFull(conn, make([]byte, 2))
+	request, err := BuildRequest(CMD_CONNECT, target)
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.Write(request)
+	reply, err := ReadReply(conn, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	return conn, reply[1]
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, string(buf))
+}
+
+func TestShutdown(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server, err := NewProxyServer(ServerConfig{EncryType: "random", Passwd: "abcedfg14", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Serve(l)
+	}()
+	serverAddr := l.Addr().String()
+
+	// 超过期限后强制关闭正在转发的连接
+	client, clientAddr, clientDone := serveTestClient(serverAddr, "abcedfg14")
+	conn, _ := dialSocks5(clientAddr, target.Addr().String())
+	echo(t, conn, "ping")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.Shutdown(ctx))
+	// 强制关闭后等待处理函数返回
+	assert.Equal(t, 0, len(client.conns.conns))
+	assert.Equal(t, ErrServerClosed, <-clientDone)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	// 停止侦听后已有的连接继续转发, 结束后Shutdown返回
+	client, clientAddr, clientDone = serveTestClient(serverAddr, "abcedfg14")
+	conn, _ = dialSocks5(clientAddr, target.Addr().String())
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(context.Background())
+	}()
+	assert.Equal(t, ErrServerClosed, <-clientDone)
+	_, err = net.Dial("tcp", clientAddr)
+	assert.NotNil(t, err)
+	echo(t, conn, "pong")
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned with active connections")
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+	assert.Nil(t, <-shutdown)
+
+	assert.Nil(t, server.Shutdown(context.Background()))
+	assert.Equal(t, ErrServerClosed, <-serverDone)
+	assert.Equal(t, ErrServerClosed, server.Serve(l))
+}
+
+func TestShutdownBackground(t *testing.T) {
+	client, err := NewProxyClient(ClientConfig{
+		ServerAddr: closedPort() + "," + closedPort(),
+		EncryType:  "random",
+		Passwd:     "abcedfg14",
+		ClientOptions: ClientOptions{
+			HealthCheck: &HealthCheckOptions{Target: "127.0.0.1:80", Interval: 10 * time.Millisecond},
+			Outbounds:   []string{"auto=url-test:proxy,direct", "hk=server:" + closedPort()},
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, client.Shutdown(context.Background()))
+
+	// 出站的测速和每个服务端池的恢复, 健康检查都已经退出
+	assert.Equal(t, 2, len(client.outbounds.pools))
+	for _, b := range []*background{&client.outbounds.bg, &client.outbounds.pools[0].bg, &client.outbounds.pools[1].bg} {
+		assert.True(t, b.closed)
+		started := false
+		b.start(func(<-chan struct{}) { started = true })
+		b.wg.Wait()
+		assert.False(t, started)
+	}
+}
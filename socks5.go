@@ -1,10 +1,16 @@
 package socks5proxy
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 const (
@@ -12,31 +18,53 @@ const (
 	METHOD_CODE   = 0x00
 )
 
+// 请求命令, 0x80以上为sckpy客户端和服务端之间的私有命令
+const (
+	CMD_CONNECT        = 0x01
+	CMD_UDP_TUNNEL     = 0x81 // UDP over TCP, 用于UDP端口转发
+	CMD_REVERSE_BIND   = 0x82 // 反向隧道, 客户端注册服务端侦听端口
+	CMD_REVERSE_ACCEPT = 0x83 // 反向隧道, 客户端为一个入站连接建立数据信道
+)
+
+// 协议解析错误, 不支持的命令和地址类型返回*ReplyError
+var (
+	ErrVersion      = errors.New("该协议不是socks5协议")
+	ErrNMethods     = errors.New("协议错误, sNMETHODS不对")
+	ErrMethod       = errors.New("协议错误, 加密方法不对")
+	ErrRequest      = errors.New("请求协议错误")
+	ErrDomainLength = errors.New("域名长度错误")
+	ErrAuth         = errors.New("用户名密码认证协议错误")
+)
+
 //go:generate mockgen -source=socks5.go -destination=socks5_mock.go -package=mock
 type Protocol interface {
 	HandleHandshake(b []byte) ([]byte, error)
 	SentHandshake(conn net.Conn) error
 }
 
-/**
-    The localConn connects to the dstServer, and sends a ver
-    identifier/method selection message:
-                +----+----------+----------+
-                |VER | NMETHODS | METHODS  |
-                +----+----------+----------+
-                | 1  |    1     | 1 to 255 |
-                +----+----------+----------+
-    The VER field is set to X'05' for this ver of the protocol.  The
-    NMETHODS field contains the number of method identifier octets that
-    appear in the METHODS field.
-    METHODS常见的几种方式如下:
-    1>.数字“0”：表示不需要用户名或者密码验证；
-    2>.数字“1”：GSSAPI是SSH支持的一种验证方式；
-    3>.数字“2”：表示需要用户名和密码进行验证；
-    4>.数字“3”至“7F”：表示用于IANA 分配(IANA ASSIGNED)
-    5>.数字“80”至“FE”表示私人方法保留(RESERVED FOR PRIVATE METHODS)
-    4>.数字“FF”：不支持所有的验证方式，无法进行连接
-**/
+/*
+*
+
+	The localConn connects to the dstServer, and sends a ver
+	identifier/method selection message:
+	            +----+----------+----------+
+	            |VER | NMETHODS | METHODS  |
+	            +----+----------+----------+
+	            | 1  |    1     | 1 to 255 |
+	            +----+----------+----------+
+	The VER field is set to X'05' for this ver of the protocol.  The
+	NMETHODS field contains the number of method identifier octets that
+	appear in the METHODS field.
+	METHODS常见的几种方式如下:
+	1>.数字“0”：表示不需要用户名或者密码验证；
+	2>.数字“1”：GSSAPI是SSH支持的一种验证方式；
+	3>.数字“2”：表示需要用户名和密码进行验证；
+	4>.数字“3”至“7F”：表示用于IANA 分配(IANA ASSIGNED)
+	5>.数字“80”至“FE”表示私人方法保留(RESERVED FOR PRIVATE METHODS)
+	4>.数字“FF”：不支持所有的验证方式，无法进行连接
+
+*
+*/
 type ProtocolVersion struct {
 	VER      uint8
 	NMETHODS uint8
@@ -46,15 +74,15 @@ type ProtocolVersion struct {
 func (s *ProtocolVersion) HandleHandshake(b []byte) ([]byte, error) {
 	n := len(b)
 	if n < 3 {
-		return nil, errors.New("协议错误, sNMETHODS不对")
+		return nil, ErrNMethods
 	}
 	s.VER = b[0] //ReadByte reads and returns a single byte，第一个参数为socks的版本号
 	if s.VER != 0x05 {
-		return nil, errors.New("协议错误, version版本不为5!")
+		return nil, ErrVersion
 	}
 	s.NMETHODS = b[1] //nmethods是记录methods的长度的。nmethods的长度是1个字节
 	if n != int(2+s.NMETHODS) {
-		return nil, errors.New("协议错误, sNMETHODS不对")
+		return nil, ErrNMethods
 	}
 	s.METHODS = b[2 : 2+s.NMETHODS] //读取指定长度信息，读取正好len(buf)长度的字节。如果字节数不是指定长度，则返回错误信息和正确的字节数
 
@@ -66,7 +94,7 @@ func (s *ProtocolVersion) HandleHandshake(b []byte) ([]byte, error) {
 	}
 
 	if s.VER != SOCKS_VERSION {
-		return nil, errors.New("该协议不是socks5协议")
+		return nil, ErrVersion
 	}
 
 	//服务器回应客户端消息:
@@ -74,7 +102,7 @@ func (s *ProtocolVersion) HandleHandshake(b []byte) ([]byte, error) {
 	// 第二个参数表示服务端选中的认证方法，0即无需密码访问, 2表示需要用户名和密码进行验证。
 	// 88是一种私有的加密协议
 	if useMethod != METHOD_CODE {
-		return nil, errors.New("协议错误, 加密方法不对")
+		return nil, ErrMethod
 	}
 	resp := []byte{SOCKS_VERSION, useMethod}
 	return resp, nil
@@ -88,6 +116,32 @@ func (s *ProtocolVersion) SentHandshake(conn net.Conn) error {
 	return nil
 }
 
+// 从流中读取greeting, 按NMETHODS读取完整的消息, 不依赖TCP读取的边界
+func ReadGreeting(r io.Reader) (*ProtocolVersion, error) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return nil, err
+	}
+	if head[0] != SOCKS_VERSION {
+		return nil, ErrVersion
+	}
+	if head[1] == 0 {
+		return nil, ErrNMethods
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(r, methods)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtocolVersion{VER: head[0], NMETHODS: head[1], METHODS: methods}, nil
+}
+
+// 是否支持无需认证的方法
+func (s *ProtocolVersion) acceptable() bool {
+	return bytes.IndexByte(s.METHODS, METHOD_CODE) >= 0
+}
+
 /*
    This begins with the client producing a
    Username/Password request:
@@ -115,6 +169,9 @@ func (s *Socks5AuthUPasswd) HandleAuth(b []byte) ([]byte, error) {
 	//     return err
 	// }
 	n := len(b)
+	if n < 2 {
+		return nil, ErrAuth
+	}
 
 	s.VER = b[0]
 	if s.VER != 5 {
@@ -122,10 +179,15 @@ func (s *Socks5AuthUPasswd) HandleAuth(b []byte) ([]byte, error) {
 	}
 
 	s.ULEN = b[1]
-	s.UNAME = string(b[2 : 2+s.ULEN])
-	s.PLEN = b[2+s.ULEN+1]
+	if n < 2+int(s.ULEN)+1 {
+		return nil, ErrAuth
+	}
+	s.UNAME = string(b[2 : 2+int(s.ULEN)])
+	s.PLEN = b[2+int(s.ULEN)]
+	if n != 2+int(s.ULEN)+1+int(s.PLEN) {
+		return nil, ErrAuth
+	}
 	s.PASSWD = string(b[n-int(s.PLEN) : n])
-	log.Println(s.UNAME, s.PASSWD)
 
 	/**
 	  回应客户端,响应客户端连接成功
@@ -148,24 +210,27 @@ func (s *Socks5AuthUPasswd) HandleAuth(b []byte) ([]byte, error) {
 	return resp, nil
 }
 
-/**
-    结构：
-    +----+-----+-------+------+----------+----------+
-    |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
-    +----+-----+-------+------+----------+----------+
-    | 1  |  1  | X'00' |  1   | Variable |    2     |
-    +----+-----+-------+------+----------+----------+
-    cmd代表客户端请求的类型，值长度也是1个字节，有三种类型：
-        1>.数字“1”：表示客户端需要你帮忙代理连接，即CONNECT ；
-        2>.数字“2”：表示让你代理服务器，帮他建立端口，即BIND ；
-        3>.数字“3”：表示UDP连接请求用来建立一个在UDP延迟过程中操作UDP数据报的连接，即UDP ASSOCIATE；
-    ATYP代表请求的远程服务器地址类型，它是一个可变参数，但是它值的长度1个字节，
-    有三种类型：
-        1>.数字“1”：表示是一个IPV4地址（IP V4 address）；
-        2>.数字“3”：表示是一个域名（DOMAINNAME）；
-        3>.数字“4”：表示是一个IPV6地址（IP V6 address）；
-
-**/
+/*
+*
+
+	结构：
+	+----+-----+-------+------+----------+----------+
+	|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	+----+-----+-------+------+----------+----------+
+	| 1  |  1  | X'00' |  1   | Variable |    2     |
+	+----+-----+-------+------+----------+----------+
+	cmd代表客户端请求的类型，值长度也是1个字节，有三种类型：
+	    1>.数字“1”：表示客户端需要你帮忙代理连接，即CONNECT ；
+	    2>.数字“2”：表示让你代理服务器，帮他建立端口，即BIND ；
+	    3>.数字“3”：表示UDP连接请求用来建立一个在UDP延迟过程中操作UDP数据报的连接，即UDP ASSOCIATE；
+	ATYP代表请求的远程服务器地址类型，它是一个可变参数，但是它值的长度1个字节，
+	有三种类型：
+	    1>.数字“1”：表示是一个IPV4地址（IP V4 address）；
+	    2>.数字“3”：表示是一个域名（DOMAINNAME）；
+	    3>.数字“4”：表示是一个IPV6地址（IP V6 address）；
+
+*
+*/
 type Socks5Resolution struct {
 	VER       uint8
 	CMD       uint8
@@ -175,61 +240,348 @@ type Socks5Resolution struct {
 	DSTPORT   uint16
 	DSTDOMAIN string
 	RAWADDR   *net.TCPAddr
+	ID        ConnID // sckpy请求头中的连接ID, 客户端和服务端的日志相同
 }
 
 func (s *Socks5Resolution) LSTRequest(b []byte) ([]byte, error) {
-	n := len(b)
-	if n < 7 {
-		return nil, errors.New("请求协议错误")
+	r := bytes.NewReader(b)
+	err := s.readFrom(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrRequest
 	}
-	s.VER = b[0]
-	if s.VER != SOCKS_VERSION {
-		return nil, errors.New("该协议不是socks5协议")
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, ErrRequest
+	}
+	err = s.Resolve()
+	if err != nil {
+		return nil, err
 	}
 
-	s.CMD = b[1]
-	if s.CMD != 1 {
-		return nil, errors.New("客户端请求类型不为代理连接, 其他功能暂时不支持.")
+	/**
+	  回应客户端,响应客户端连接成功
+	      +----+-----+-------+------+----------+----------+
+	      |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	      +----+-----+-------+------+----------+----------+
+	      | 1  |  1  | X'00' |  1   | Variable |    2     |
+	      +----+-----+-------+------+----------+----------+
+	*/
+	resp := []byte{SOCKS_VERSION, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+	return resp, nil
+}
+
+// 从流中读取请求, 按ATYP和域名长度读取完整的消息, 不依赖TCP读取的边界.
+// 域名不解析, 需要时调用Resolve
+func ReadRequest(r io.Reader) (*Socks5Resolution, error) {
+	s := &Socks5Resolution{}
+	err := s.readFrom(r)
+	if err != nil {
+		return nil, err
 	}
-	s.RSV = b[2] //RSV保留字端，值长度为1个字节
+	return s, nil
+}
 
-	s.ATYP = b[3]
+func (s *Socks5Resolution) readFrom(r io.Reader) error {
+	head := make([]byte, 4)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return err
+	}
+	s.VER = head[0]
+	if s.VER != SOCKS_VERSION {
+		return ErrVersion
+	}
 
+	s.CMD = head[1]
+	switch s.CMD {
+	case CMD_CONNECT, CMD_UDP_TUNNEL, CMD_REVERSE_BIND, CMD_REVERSE_ACCEPT:
+	default:
+		// 客户端请求类型不为代理连接, 其他功能暂时不支持
+		return &ReplyError{Rep: REP_COMMAND_NOT_SUPPORTED}
+	}
+	s.RSV = head[2] //RSV保留字端，值长度为1个字节
+	s.ATYP = head[3]
+
+	var addrLen int
 	switch s.ATYP {
 	case 1:
 		//	IP V4 address: X'01'
-		s.DSTADDR = b[4 : 4+net.IPv4len]
+		addrLen = net.IPv4len
 	case 3:
-		//	DOMAINNAME: X'03'
-		s.DSTDOMAIN = string(b[5 : n-2])
-		ipAddr, err := net.ResolveIPAddr("ip", s.DSTDOMAIN)
+		//	DOMAINNAME: X'03', 第一个字节为域名长度
+		l := make([]byte, 1)
+		_, err = io.ReadFull(r, l)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		s.DSTADDR = ipAddr.IP
+		if l[0] == 0 {
+			return ErrDomainLength
+		}
+		addrLen = int(l[0])
 	case 4:
 		//	IP V6 address: X'04'
-		s.DSTADDR = b[4 : 4+net.IPv6len]
+		addrLen = net.IPv6len
 	default:
-		return nil, errors.New("IP地址错误")
+		// IP地址错误
+		return &ReplyError{Rep: REP_ADDRESS_NOT_SUPPORTED}
 	}
 
-	s.DSTPORT = binary.BigEndian.Uint16(b[n-2 : n])
-	// DSTADDR全部换成IP地址，可以防止DNS污染和封杀
+	addr := make([]byte, addrLen+2)
+	_, err = io.ReadFull(r, addr)
+	if err != nil {
+		return err
+	}
+	s.DSTPORT = binary.BigEndian.Uint16(addr[addrLen:])
+	if s.ATYP == 3 {
+		s.DSTDOMAIN = string(addr[:addrLen])
+		return nil
+	}
+	s.DSTADDR = addr[:addrLen]
 	s.RAWADDR = &net.TCPAddr{
 		IP:   s.DSTADDR,
 		Port: int(s.DSTPORT),
 	}
+	return nil
+}
 
-	/**
-	  回应客户端,响应客户端连接成功
-	      +----+-----+-------+------+----------+----------+
-	      |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
-	      +----+-----+-------+------+----------+----------+
-	      | 1  |  1  | X'00' |  1   | Variable |    2     |
-	      +----+-----+-------+------+----------+----------+
-	*/
-	resp := []byte{SOCKS_VERSION, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+// 解析域名, DSTADDR全部换成IP地址，可以防止DNS污染和封杀
+func (s *Socks5Resolution) Resolve() error {
+	return s.resolve(context.Background(), nil)
+}
 
-	return resp, nil
+// 用指定的DNS解析, resolver为空时使用系统的DNS设置, ctx限制解析的时间
+func (s *Socks5Resolution) resolve(ctx context.Context, resolver *net.Resolver) error {
+	if s.RAWADDR != nil {
+		return nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, s.DSTDOMAIN)
+	if err != nil {
+		return err
+	}
+	// 和net.ResolveIPAddr一样优先使用IPv4地址
+	s.DSTADDR = ips[0].IP
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			s.DSTADDR = ip.IP
+			break
+		}
+	}
+	s.RAWADDR = &net.TCPAddr{
+		IP:   s.DSTADDR,
+		Port: int(s.DSTPORT),
+	}
+	return nil
+}
+
+// 目标地址, 域名请求为"域名:端口"
+func (s *Socks5Resolution) Addr() string {
+	if len(s.DSTDOMAIN) > 0 {
+		return net.JoinHostPort(s.DSTDOMAIN, strconv.Itoa(int(s.DSTPORT)))
+	}
+	return s.RAWADDR.String()
+}
+
+// sock5应答码
+const (
+	REP_SUCCEEDED             = 0x00
+	REP_FAILURE               = 0x01 // 普通的SOCKS服务器故障
+	REP_NOT_ALLOWED           = 0x02 // 规则不允许的连接
+	REP_NETWORK_UNREACHABLE   = 0x03 // 网络不可达
+	REP_HOST_UNREACHABLE      = 0x04 // 主机不可达
+	REP_CONNECTION_REFUSED    = 0x05 // 连接被拒
+	REP_TTL_EXPIRED           = 0x06 // TTL超时
+	REP_COMMAND_NOT_SUPPORTED = 0x07 // 不支持的命令
+	REP_ADDRESS_NOT_SUPPORTED = 0x08 // 不支持的地址类型
+)
+
+var replyMessages = map[byte]string{
+	REP_FAILURE:               "general failure",
+	REP_NOT_ALLOWED:           "connection not allowed",
+	REP_NETWORK_UNREACHABLE:   "network unreachable",
+	REP_HOST_UNREACHABLE:      "host unreachable",
+	REP_CONNECTION_REFUSED:    "connection refused",
+	REP_TTL_EXPIRED:           "TTL expired",
+	REP_COMMAND_NOT_SUPPORTED: "command not supported",
+	REP_ADDRESS_NOT_SUPPORTED: "address type not supported",
+}
+
+// 对端回应的失败应答, 客户端把服务端的应答码原样回应给应用
+type ReplyError struct {
+	Rep byte
+}
+
+func (e *ReplyError) Error() string {
+	msg, ok := replyMessages[e.Rep]
+	if !ok {
+		msg = "unknown"
+	}
+	return fmt.Sprintf("socks5 reply %d, %s", e.Rep, msg)
+}
+
+// 把连接目标的错误转换成sock5应答码
+func ReplyCode(err error) byte {
+	if err == nil {
+		return REP_SUCCEEDED
+	}
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Rep
+	}
+	if errors.Is(err, errRejected) {
+		return REP_NOT_ALLOWED
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return REP_CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return REP_NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return REP_HOST_UNREACHABLE
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return REP_HOST_UNREACHABLE
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return REP_TTL_EXPIRED
+	}
+	return REP_FAILURE
+}
+
+// 构造sock5应答, 绑定地址按IPv4/IPv6/域名分别编码, 为空时填0.0.0.0:0
+func BuildReply(rep byte, bind net.Addr) []byte {
+	host, port := "0.0.0.0", 0
+	if bind != nil {
+		h, p, err := net.SplitHostPort(bind.String())
+		if n, perr := strconv.Atoi(p); err == nil && perr == nil && len(h) <= 255 {
+			host, port = h, n
+		}
+	}
+	return appendAddr([]byte{SOCKS_VERSION, rep, 0x00}, host, port)
+}
+
+// 编码ATYP, 地址和端口, IPv6的zone不编码
+func appendAddr(b []byte, host string, port int) []byte {
+	if i := strings.IndexByte(host, '%'); i >= 0 && net.ParseIP(host[:i]) != nil {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x01)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, 0x04)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, 0x03, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// 域名类型的绑定地址
+type domainAddr struct {
+	host string
+	port int
+}
+
+func (a *domainAddr) Network() string { return "tcp" }
+func (a *domainAddr) String() string  { return net.JoinHostPort(a.host, strconv.Itoa(a.port)) }
+
+// 解析ReadReply读到的应答中的绑定地址, IP地址返回*net.TCPAddr
+func ParseReplyAddr(reply []byte) (net.Addr, error) {
+	n := len(reply)
+	if n < 7 {
+		return nil, errors.New("应答长度错误")
+	}
+	port := int(binary.BigEndian.Uint16(reply[n-2:]))
+	switch reply[3] {
+	case 0x01, 0x04:
+		ip := net.IP(append([]byte(nil), reply[4:n-2]...))
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			return nil, errors.New("IP地址错误")
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case 0x03:
+		if int(reply[4]) != n-7 {
+			return nil, ErrDomainLength
+		}
+		return &domainAddr{host: string(reply[5 : n-2]), port: port}, nil
+	}
+	return nil, errors.New("IP地址错误")
+}
+
+// 对端应答了绑定地址的连接, LocalAddr返回对端的绑定地址
+type boundConn struct {
+	net.Conn
+	bind net.Addr
+}
+
+func (c *boundConn) LocalAddr() net.Addr {
+	return c.bind
+}
+
+func (c *boundConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// 按ATYP读取完整的sock5应答, decrypt为nil时不解密
+func ReadReply(r io.Reader, decrypt func(b []byte) error) ([]byte, error) {
+	resp := make([]byte, 5)
+	_, err := io.ReadFull(r, resp)
+	if err != nil {
+		return nil, err
+	}
+	if decrypt != nil {
+		decrypt(resp)
+	}
+	if resp[0] != SOCKS_VERSION {
+		return nil, errors.New("该协议不是socks5协议")
+	}
+
+	// 剩余长度: 地址 + 2字节端口, ATYP=1/4时第5个字节已经是地址的一部分
+	var left int
+	switch resp[3] {
+	case 0x01:
+		left = net.IPv4len - 1 + 2
+	case 0x03:
+		left = int(resp[4]) + 2
+	case 0x04:
+		left = net.IPv6len - 1 + 2
+	default:
+		return nil, errors.New("IP地址错误")
+	}
+	rest := make([]byte, left)
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, err
+	}
+	if decrypt != nil {
+		decrypt(rest)
+	}
+	return append(resp, rest...), nil
+}
+
+// 构造sock5请求, 目标地址按IPv4/IPv6/域名分别编码
+func BuildRequest(cmd byte, addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) == nil && (len(host) == 0 || len(host) > 255) {
+		return nil, ErrDomainLength
+	}
+	return appendAddr([]byte{SOCKS_VERSION, cmd, 0x00}, host, int(port)), nil
 }
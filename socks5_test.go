@@ -0,0 +1,325 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 一个没有服务侦听的本机端口
+func closedPort() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestReplyCode(t *testing.T) {
+	assert.Equal(t, byte(REP_SUCCEEDED), ReplyCode(nil))
+	assert.Equal(t, byte(REP_FAILURE), ReplyCode(errors.New("x")))
+	assert.Equal(t, byte(REP_NOT_ALLOWED), ReplyCode(errRejected))
+	assert.Equal(t, byte(REP_TTL_EXPIRED), ReplyCode(&ReplyError{Rep: REP_TTL_EXPIRED}))
+
+	_, err := net.Dial("tcp", closedPort())
+	assert.Equal(t, byte(REP_CONNECTION_REFUSED), ReplyCode(err))
+
+	_, err = net.ResolveIPAddr("ip", "nonexistent.invalid")
+	assert.Equal(t, byte(REP_HOST_UNREACHABLE), ReplyCode(err))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, byte(REP_TTL_EXPIRED), ReplyCode(err))
+
+	var request Socks5Resolution
+	_, err = request.LSTRequest([]byte{SOCKS_VERSION, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+	assert.Equal(t, byte(REP_COMMAND_NOT_SUPPORTED), ReplyCode(err))
+	_, err = request.LSTRequest([]byte{SOCKS_VERSION, CMD_CONNECT, 0x00, 0x09, 127, 0, 0, 1, 0, 80})
+	assert.Equal(t, byte(REP_ADDRESS_NOT_SUPPORTED), ReplyCode(err))
+}
+
+// 目标连接失败时, 服务端的应答码经过客户端原样回应给应用
+func TestReplyPropagation(t *testing.T) {
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg10", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	clientAddr := startTestClient(t, ClientConfig{
+		ServerAddr:    serverAddr,
+		EncryType:     "random",
+		Passwd:        "abcedfg10",
+		RecvHTTPProto: "sock5",
+		ClientOptions: ClientOptions{Rules: []string{"127.0.0.1=" + OUTBOUND_PROXY}},
+	})
+
+	target := closedPort()
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Write([]byte{SOCKS_VERSION, 0x01, METHOD_CODE})
+	assert.Nil(t, err)
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+
+	request, err := BuildRequest(CMD_CONNECT, target)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = conn.Write(request)
+	assert.Nil(t, err)
+	reply, err := ReadReply(conn, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(REP_CONNECTION_REFUSED), reply[1])
+
+	// 目标连接失败不影响服务端的可用状态
+	endpoints, err := ParseServerList(serverAddr, "random", "abcedfg10")
+	if err != nil {
+		log.Panic(err)
+	}
+	pool, err := NewServerPool(endpoints, POLICY_FAILOVER, 0)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer pool.Close()
+	_, _, _, err = pool.dialTunnel(context.Background(), request)
+	assert.Equal(t, byte(REP_CONNECTION_REFUSED), ReplyCode(err))
+	assert.True(t, pool.Status()[0].Up)
+}
+
+func TestBuildReply(t *testing.T) {
+	assert.Equal(t, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}, BuildReply(REP_SUCCEEDED, nil))
+	var none *net.TCPAddr
+	assert.Equal(t, []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}, BuildReply(REP_FAILURE, none))
+
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 8080},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		&net.UDPAddr{IP: net.ParseIP("::1"), Port: 53},
+		&domainAddr{host: "bind.example.com", port: 1080},
+	} {
+		reply := BuildReply(REP_SUCCEEDED, addr)
+		full, err := ReadReply(bytes.NewReader(reply), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, reply, full)
+		bind, err := ParseReplyAddr(reply)
+		assert.Nil(t, err)
+		assert.Equal(t, addr.String(), bind.String())
+	}
+	assert.Equal(t, byte(0x04), BuildReply(REP_SUCCEEDED, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1})[3])
+	assert.Equal(t, byte(0x03), BuildReply(REP_SUCCEEDED, &domainAddr{host: "a.b", port: 1})[3])
+
+	_, err := ParseReplyAddr([]byte{5, 0, 0, 3, 9, 'a', 0, 80})
+	assert.NotNil(t, err)
+}
+
+// 应用收到的绑定地址是服务端连接目标时使用的地址
+func TestReplyBindAddr(t *testing.T) {
+	peers := make(chan string, 1)
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		peers <- conn.RemoteAddr().String()
+		io.Copy(conn, conn)
+	}()
+
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg11", ServerOptions: ServerOptions{ACL: loopbackACL}})
+	clientAddr := startTestClient(t, ClientConfig{
+		ServerAddr:    serverAddr,
+		EncryType:     "random",
+		Passwd:        "abcedfg11",
+		RecvHTTPProto: "sock5",
+		ClientOptions: ClientOptions{Rules: []string{"127.0.0.1=" + OUTBOUND_PROXY}},
+	})
+
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{SOCKS_VERSION, 0x01, METHOD_CODE})
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	assert.Nil(t, err)
+	request, err := BuildRequest(CMD_CONNECT, echo.Addr().String())
+	if err != nil {
+		log.Panic(err)
+	}
+	conn.Write(request)
+	reply, err := ReadReply(conn, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(REP_SUCCEEDED), reply[1])
+	bind, err := ParseReplyAddr(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, <-peers, bind.String())
+}
+
+func TestReadGreeting(t *testing.T) {
+	// 按字节到达的greeting
+	proto, err := ReadGreeting(iotest.OneByteReader(bytes.NewReader([]byte{5, 2, 2, 0, 'x'})))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{2, 0}, proto.METHODS)
+	assert.True(t, proto.acceptable())
+
+	_, err = ReadGreeting(bytes.NewReader([]byte{4, 1, 0}))
+	assert.Equal(t, ErrVersion, err)
+	_, err = ReadGreeting(bytes.NewReader([]byte{5, 0}))
+	assert.Equal(t, ErrNMethods, err)
+	_, err = ReadGreeting(bytes.NewReader([]byte{5, 3, 0}))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReadRequest(t *testing.T) {
+	for _, addr := range []string{"10.1.2.3:80", "[2001:db8::1]:443", "www.example.com:8080"} {
+		b, err := BuildRequest(CMD_CONNECT, addr)
+		if err != nil {
+			log.Panic(err)
+		}
+		// 请求和之后的数据在同一个数据包中, 并且按字节到达
+		r := iotest.OneByteReader(bytes.NewReader(append(b, "payload"...)))
+		request, err := ReadRequest(r)
+		assert.Nil(t, err, addr)
+		assert.Equal(t, addr, request.Addr())
+		rest, _ := io.ReadAll(r)
+		assert.Equal(t, "payload", string(rest))
+	}
+
+	request, err := ReadRequest(bytes.NewReader([]byte{5, 1, 0, 3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80}))
+	assert.Nil(t, err)
+	assert.Nil(t, request.RAWADDR)
+	assert.Nil(t, request.Resolve())
+	assert.True(t, request.RAWADDR.IP.IsLoopback())
+
+	_, err = ReadRequest(bytes.NewReader([]byte{4, 1, 0, 1, 1, 2, 3, 4, 0, 80}))
+	assert.Equal(t, ErrVersion, err)
+	_, err = ReadRequest(bytes.NewReader([]byte{5, 1, 0, 3, 0, 0, 80}))
+	assert.Equal(t, ErrDomainLength, err)
+	_, err = ReadRequest(bytes.NewReader([]byte{5, 1, 0, 3, 20, 'a', 0, 80}))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = ReadRequest(bytes.NewReader([]byte{5, 3, 0, 1, 1, 2, 3, 4, 0, 80}))
+	assert.Equal(t, byte(REP_COMMAND_NOT_SUPPORTED), ReplyCode(err))
+
+	var s Socks5Resolution
+	_, err = s.LSTRequest([]byte{5, 1, 0, 3, 20, 'a', 0, 80})
+	assert.Equal(t, ErrRequest, err)
+	_, err = s.LSTRequest([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80, 0})
+	assert.Equal(t, ErrRequest, err)
+}
+
+func TestHandleAuth(t *testing.T) {
+	var auth Socks5AuthUPasswd
+	resp, err := auth.HandleAuth([]byte{5, 2, 'u', 'n', 2, 'p', 'w'})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{SOCKS_VERSION, 0x00}, resp)
+	assert.Equal(t, "un", auth.UNAME)
+	assert.Equal(t, "pw", auth.PASSWD)
+
+	for _, b := range [][]byte{{}, {5}, {5, 9, 'u'}, {5, 1, 'u'}, {5, 1, 'u', 3, 'p'}} {
+		_, err = auth.HandleAuth(b)
+		assert.Equal(t, ErrAuth, err, "%v", b)
+	}
+}
+
+func FuzzReadGreeting(f *testing.F) {
+	f.Add([]byte{5, 1, 0})
+	f.Add([]byte{5, 2, 0, 2})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		proto, err := ReadGreeting(bytes.NewReader(b))
+		if err == nil && int(proto.NMETHODS) != len(proto.METHODS) {
+			t.Fatalf("methods length %d != %d", len(proto.METHODS), proto.NMETHODS)
+		}
+		var p ProtocolVersion
+		p.HandleHandshake(b)
+	})
+}
+
+func FuzzReadRequest(f *testing.F) {
+	for _, addr := range []string{"10.1.2.3:80", "[::1]:443", "example.com:8080"} {
+		b, _ := BuildRequest(CMD_CONNECT, addr)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		request, err := ReadRequest(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		// 解析成功的请求重新编码后可以再次解析
+		host := request.DSTDOMAIN
+		if request.RAWADDR != nil {
+			host = request.RAWADDR.IP.String()
+		}
+		b = appendAddr([]byte{SOCKS_VERSION, request.CMD, 0x00}, host, int(request.DSTPORT))
+		again, err := ReadRequest(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.CMD != request.CMD || again.DSTPORT != request.DSTPORT {
+			t.Fatalf("%v != %v", again, request)
+		}
+	})
+}
+
+func FuzzHandleAuth(f *testing.F) {
+	f.Add([]byte{5, 2, 'u', 'n', 2, 'p', 'w'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var auth Socks5AuthUPasswd
+		auth.HandleAuth(b)
+	})
+}
+
+func FuzzReadReply(f *testing.F) {
+	f.Add(BuildReply(REP_SUCCEEDED, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}))
+	f.Add(BuildReply(REP_SUCCEEDED, &domainAddr{host: "example.com", port: 80}))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		reply, err := ReadReply(bytes.NewReader(b), nil)
+		if err == nil {
+			ParseReplyAddr(reply)
+		}
+	})
+}
+
+func TestResolveTimeout(t *testing.T) {
+	// 不应答的DNS服务器, 解析在ctx结束时返回
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	resolver, err := NewResolver(dns.LocalAddr().String())
+	assert.Nil(t, err)
+	request := &Socks5Resolution{DSTDOMAIN: "example.com", DSTPORT: 80}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = request.resolve(ctx, resolver)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second, time.Since(start))
+}
@@ -0,0 +1,100 @@
+package socks5proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 超时设置, 0为不限制
+type Timeouts struct {
+	Handshake time.Duration // 连接建立后完成sock5协商或读取请求头的时间
+	Dial      time.Duration // 连接目标的时间, 客户端建立加密信道时再加上Handshake
+	Idle      time.Duration // 两个方向都没有数据的时间, 任意方向有数据时重新计时
+	Lifetime  time.Duration // 连接的最长时间
+}
+
+// 默认超时, 不限制连接的最长时间
+var DefaultTimeouts = Timeouts{
+	Handshake: 10 * time.Second,
+	Dial:      10 * time.Second,
+	Idle:      5 * time.Minute,
+}
+
+var (
+	errIdleTimeout      = errors.New("连接空闲超时")
+	errLifetimeExceeded = errors.New("连接超过最长时间")
+)
+
+// 各种超时发生的次数
+type TimeoutStatus struct {
+	Handshake int64 `json:"handshake"`
+	Dial      int64 `json:"dial"`
+	Idle      int64 `json:"idle"`
+	Lifetime  int64 `json:"lifetime"`
+}
+
+// 超时次数的计数, ProxyServer, ProxyClient和Dialer各自统计, 为nil时不计数
+type timeoutCounters struct {
+	handshake int64
+	dial      int64
+	idle      int64
+	lifetime  int64
+}
+
+func (c *timeoutCounters) status() TimeoutStatus {
+	if c == nil {
+		return TimeoutStatus{}
+	}
+	return TimeoutStatus{
+		Handshake: atomic.LoadInt64(&c.handshake),
+		Dial:      atomic.LoadInt64(&c.dial),
+		Idle:      atomic.LoadInt64(&c.idle),
+		Lifetime:  atomic.LoadInt64(&c.lifetime),
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// 超时错误计入统计
+func countTimeout(counter *int64, err error) {
+	if err != nil && isTimeout(err) {
+		atomic.AddInt64(counter, 1)
+	}
+}
+
+// 握手期间的读写超时, 握手完成后调用返回的函数清除
+func (t Timeouts) handshakeDeadline(conn net.Conn) func() {
+	if t.Handshake <= 0 {
+		return func() {}
+	}
+	conn.SetDeadline(time.Now().Add(t.Handshake))
+	return func() {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// 解析和连接目标用的ctx, parent结束时一起结束
+func (t Timeouts) dialContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if t.Dial <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, t.Dial)
+}
+
+// 客户端建立加密信道用的ctx, 服务端连接目标最多用Dial, 客户端再多等Handshake,
+// 避免服务端还在连接目标时客户端先超时
+func (t Timeouts) tunnelContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if t.Dial <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, t.Dial+t.Handshake)
+}
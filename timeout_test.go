@@ -0,0 +1,109 @@
+package socks5proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 一对相连的TCP连接
+func tcpPair() (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer l.Close()
+	a, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		log.Panic(err)
+	}
+	b, err := l.AcceptTCP()
+	if err != nil {
+		log.Panic(err)
+	}
+	return a, b
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	var counters timeoutCounters
+
+	// 有数据时重新计算空闲时间
+	app, left := tcpPair()
+	right, target := tcpPair()
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			app.Write([]byte("x"))
+		}
+	}()
+	start := time.Now()
+	up, _, err := relay(context.Background(), left, right, Timeouts{Idle: 150 * time.Millisecond}, &counters)
+	assert.Equal(t, errIdleTimeout, err)
+	assert.Equal(t, int64(5), up)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	// 超时后两端都被关闭
+	_, err = io.ReadAll(target)
+	assert.Nil(t, err)
+	app.Close()
+
+	app, left = tcpPair()
+	right, target = tcpPair()
+	go io.Copy(target, target)
+	go func() {
+		for {
+			_, err := app.Write([]byte("x"))
+			if err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	_, _, err = relay(context.Background(), left, right, Timeouts{Idle: time.Second, Lifetime: 200 * time.Millisecond}, &counters)
+	assert.Equal(t, errLifetimeExceeded, err)
+	app.Close()
+
+	assert.Equal(t, TimeoutStatus{Idle: 1, Lifetime: 1}, counters.status())
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server, err := NewProxyServer(ServerConfig{
+		EncryType:     "random",
+		Passwd:        "abcedfg13",
+		ServerOptions: ServerOptions{Timeouts: &Timeouts{Handshake: 200 * time.Millisecond}},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+	serverAddr := l.Addr().String()
+	// 其他服务端的超时不计入这个服务端
+	other, err := NewProxyServer(ServerConfig{EncryType: "random", Passwd: "abcedfg13"})
+	if err != nil {
+		log.Panic(err)
+	}
+	defer other.Shutdown(context.Background())
+
+	// 连接后不发送数据, 服务端超时后关闭连接
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool {
+		return server.TimeoutStats().Handshake == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, TimeoutStatus{}, other.TimeoutStats())
+}
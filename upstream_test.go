@@ -0,0 +1,236 @@
+package socks5proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用的上游socks5代理, 要求用户名密码认证
+func startSocks5Upstream(t *testing.T, user, pass string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				n, _ := conn.Read(buf)
+				var proto ProtocolVersion
+				if _, err := proto.HandleHandshake(buf[:n]); err != nil {
+					return
+				}
+				conn.Write([]byte{SOCKS_VERSION, 0x02})
+				n, _ = conn.Read(buf)
+				ulen := int(buf[1])
+				if n < 3+ulen || string(buf[2:2+ulen]) != user || string(buf[3+ulen:n]) != pass {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+				n, _ = conn.Read(buf)
+				var request Socks5Resolution
+				resp, err := request.LSTRequest(buf[:n])
+				if err != nil {
+					return
+				}
+				dst, err := net.DialTCP("tcp", nil, request.RAWADDR)
+				if err != nil {
+					return
+				}
+				defer dst.Close()
+				conn.Write(resp)
+				go io.Copy(dst, conn)
+				io.Copy(conn, dst)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// 测试用的上游http代理, 只支持CONNECT
+func startHTTPUpstream(t *testing.T, auth string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(dst, rw.Reader)
+		io.Copy(conn, dst)
+	}))
+	return l
+}
+
+func TestUpstreamChain(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	socks := startSocks5Upstream(t, "alice", "secret")
+	defer socks.Close()
+	proxy := startHTTPUpstream(t, "Basic Ym9iOnB3ZA==") // bob:pwd
+	defer proxy.Close()
+
+	router, err := ParseUpstreamRules([]string{
+		"corp.example=http://bob:pwd@" + proxy.Addr().String() + ",socks5://alice:secret@" + socks.Addr().String(),
+		"socks5://alice:wrong@" + socks.Addr().String(),
+	})
+	assert.Nil(t, err)
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	_, direct := router.Route("127.0.0.1").(*net.Dialer)
+	assert.False(t, direct)
+
+	// 默认规则密码错误
+	_, err = router.DialContext(context.Background(), "tcp", "127.0.0.1:"+port)
+	assert.NotNil(t, err)
+
+	// http -> socks5 -> echo
+	// 按域名边界匹配
+	d := router.Route("db.corp.example")
+	assert.True(t, d == router.Route("corp.example"))
+	assert.True(t, router.Default == router.Route("evilcorp.example"))
+	assert.False(t, d == router.Default)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", "127.0.0.1:"+port)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+
+	msg := "hello upstream\n"
+	_, err = conn.Write([]byte(msg))
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, msg, line)
+}
+
+func TestParseUpstreamError(t *testing.T) {
+	for _, spec := range []string{"ftp://host:21", "socks5://", "://bad"} {
+		_, err := ParseUpstream(spec)
+		assert.NotNil(t, err, spec)
+	}
+	d, err := ParseUpstream("direct")
+	assert.Nil(t, err)
+	_, direct := d.(*net.Dialer)
+	assert.True(t, direct)
+}
+
+func TestUpstreamDialRequest(t *testing.T) {
+	d := &recordDialer{}
+	router := &UpstreamRouter{Default: d}
+	addr, _ := net.ResolveTCPAddr("tcp", closedPort())
+	request := &Socks5Resolution{DSTDOMAIN: "localhost", DSTPORT: uint16(addr.Port), RAWADDR: addr}
+	// 默认发送检查过的IP
+	router.dialRequest(context.Background(), request, &net.Dialer{})
+	router.RemoteDNS = true
+	router.dialRequest(context.Background(), request, &net.Dialer{})
+	assert.Equal(t, []string{"tcp/" + addr.String(), "tcp/" + net.JoinHostPort("localhost", strconv.Itoa(addr.Port))}, d.addrs)
+
+	// 规则为直连时使用嵌入配置的拨号器
+	direct := &recordDialer{}
+	router, err := ParseUpstreamRules(nil)
+	assert.Nil(t, err)
+	router.dialRequest(context.Background(), request, direct)
+	router.withDirect(direct).DialContext(context.Background(), "tcp", addr.String())
+	assert.Equal(t, []string{"tcp/" + addr.String(), "tcp/" + addr.String()}, direct.addrs)
+}
+
+func TestUpstreamRemoteDNS(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	socks := startSocks5Upstream(t, "alice", "secret")
+	defer socks.Close()
+
+	// 服务端的DNS不可用, 本地解析时localhost也会被默认规则禁止, 只有交给上游解析才能连通
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer dns.Close()
+	resolver, err := NewResolver(dns.LocalAddr().String())
+	assert.Nil(t, err)
+	upstream, err := ParseUpstreamRules([]string{"socks5h://alice:secret@" + socks.Addr().String()})
+	assert.Nil(t, err)
+	timeouts := DefaultTimeouts
+	timeouts.Dial = time.Second
+	serverAddr := startTestServer(t, ServerConfig{EncryType: "random", Passwd: "abcedfg9", ServerOptions: ServerOptions{
+		Upstream: upstream,
+		Resolver: resolver,
+		Timeouts: &timeouts,
+	}})
+
+	addr, _ := net.ResolveTCPAddr("tcp", serverAddr)
+	auth, _ := CreateAuth("random", "abcedfg9")
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	request, _ := BuildRequest(CMD_CONNECT, "localhost:"+port)
+	conn, _, err := dialTunnel(context.Background(), addr, auth, "abcedfg9", request)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	tunnel := &cipherConn{Conn: conn, auth: auth}
+	_, err = tunnel.Write([]byte("hello"))
+	assert.Nil(t, err)
+	resp := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(tunnel, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(resp))
+}
@@ -0,0 +1,325 @@
+package socks5proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 没有用户文件时, -passwd对应的用户名
+	DEFAULT_USER = "default"
+	// 用户文件修改检查间隔
+	userReloadInterval = 2 * time.Second
+)
+
+// 用户, 每个用户有自己的加密方法和密码
+type User struct {
+	Name      string
+	EncryType string
+	Passwd    string
+	Limits    UserLimits
+	ACL       *ACL // 用户的访问控制规则, 优先于全局规则
+
+	auth        socks5Auth
+	stats       *userStats
+	upLimiter   *rateLimiter
+	downLimiter *rateLimiter
+	global      *globalLimiter
+}
+
+// 用户统计, 重新加载用户文件后保留
+type userStats struct {
+	connections int64
+	active      int64
+	up          int64
+	down        int64
+
+	mu        sync.Mutex
+	quota     quotaCounter
+	dirty     bool   // 流量计数有变化, 需要写回文件
+	exhausted string // 最近一次配额用完的日期和原因, 用于只记录一次日志
+}
+
+func (u *User) connect() {
+	atomic.AddInt64(&u.stats.connections, 1)
+	atomic.AddInt64(&u.stats.active, 1)
+}
+
+func (u *User) disconnect() {
+	atomic.AddInt64(&u.stats.active, -1)
+}
+
+func (u *User) addTraffic(up int64, down int64) {
+	atomic.AddInt64(&u.stats.up, up)
+	atomic.AddInt64(&u.stats.down, down)
+}
+
+// 用户统计
+type UserStatus struct {
+	Name         string `json:"name"`
+	Connections  int64  `json:"connections"`
+	Active       int64  `json:"active"`
+	BytesUp      int64  `json:"bytes_up"`
+	BytesDown    int64  `json:"bytes_down"`
+	DailyBytes   int64  `json:"daily_bytes"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+}
+
+// 用户库, 从文件加载, 文件修改后自动重新加载
+type UserDB struct {
+	path string
+
+	mu      sync.RWMutex
+	users   []*User
+	stats   map[string]*userStats
+	modTime time.Time
+	global  globalLimiter
+
+	bg     background // 监视用户文件和写回流量计数
+	logger *slog.Logger
+}
+
+// 只有一个用户的用户库, 用于单密码的服务端
+func NewStaticUserDB(encrytype string, passwd string) (*UserDB, error) {
+	db := &UserDB{stats: make(map[string]*userStats)}
+	users, err := db.build([]User{{Name: DEFAULT_USER, EncryType: encrytype, Passwd: passwd}})
+	if err != nil {
+		return nil, err
+	}
+	db.users = users
+	return db, nil
+}
+
+// 加载用户文件并在后台监视修改, 每行一个用户, 可以带限速, 流量配额和访问控制规则:
+//
+//	# 用户名 加密方法 密码 [up=上传速度] [down=下载速度] [daily=每日流量] [monthly=每月流量] [allow:目标] [deny:目标]
+//	alice random s3cret up=1M down=4M allow:10.1.0.0/16
+//	bob   simple passw0rd monthly=100G
+func LoadUserDB(path string) (*UserDB, error) {
+	db := &UserDB{path: path, stats: make(map[string]*userStats)}
+	err := db.reload()
+	if err != nil {
+		return nil, err
+	}
+	db.bg.start(db.watch)
+	return db, nil
+}
+
+func (db *UserDB) reload() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(db.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	defs, err := parseUsers(db.path, f)
+	if err != nil {
+		return err
+	}
+
+	users, err := db.build(defs)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	db.users = users
+	db.modTime = info.ModTime()
+	db.mu.Unlock()
+	db.log().Info("load users", "count", len(users), "file", db.path)
+	return nil
+}
+
+// 解析用户定义, 每行一个用户, name用在错误信息中
+func parseUsers(name string, r io.Reader) ([]User, error) {
+	var defs []User
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d, 用户格式错误", name, line)
+		}
+		var options, rules []string
+		for _, item := range fields[3:] {
+			if strings.HasPrefix(item, "allow:") || strings.HasPrefix(item, "deny:") {
+				rules = append(rules, item)
+			} else {
+				options = append(options, item)
+			}
+		}
+		limits, err := parseUserLimits(options)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d, %v", name, line, err)
+		}
+		acl, err := ParseACL(rules)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d, %v", name, line, err)
+		}
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("%s:%d, 用户重复, %s", name, line, fields[0])
+		}
+		seen[fields[0]] = true
+		defs = append(defs, User{Name: fields[0], EncryType: fields[1], Passwd: fields[2], Limits: limits, ACL: acl})
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("%s, 没有用户", name)
+	}
+	return defs, nil
+}
+
+// 配置文件中的用户, 每项一个用户, 格式和用户文件的一行相同, 不会重新加载
+func ParseUserDB(lines []string) (*UserDB, error) {
+	db := &UserDB{stats: make(map[string]*userStats)}
+	defs, err := parseUsers("users", strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	users, err := db.build(defs)
+	if err != nil {
+		return nil, err
+	}
+	db.users = users
+	return db, nil
+}
+
+func (db *UserDB) build(defs []User) ([]*User, error) {
+	var users []*User
+	for _, def := range defs {
+		auth, err := CreateAuth(def.EncryType, def.Passwd)
+		if err != nil {
+			return nil, fmt.Errorf("用户 %s, %v", def.Name, err)
+		}
+		db.mu.Lock()
+		stats, ok := db.stats[def.Name]
+		if !ok {
+			stats = &userStats{}
+			db.stats[def.Name] = stats
+		}
+		db.mu.Unlock()
+
+		u := def
+		u.auth = auth
+		u.stats = stats
+		u.upLimiter = newRateLimiter(def.Limits.UploadRate)
+		u.downLimiter = newRateLimiter(def.Limits.DownloadRate)
+		u.global = &db.global
+		users = append(users, &u)
+	}
+	return users, nil
+}
+
+// 文件修改后重新加载, 加载失败时继续使用原来的用户
+func (db *UserDB) watch(stop <-chan struct{}) {
+	for sleepOrStop(stop, userReloadInterval) {
+		info, err := os.Stat(db.path)
+		if err != nil {
+			continue
+		}
+		db.mu.RLock()
+		changed := !info.ModTime().Equal(db.modTime)
+		db.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		err = db.reload()
+		if err != nil {
+			db.log().Error("reload users fail", "err", err)
+			db.mu.Lock()
+			db.modTime = info.ModTime()
+			db.mu.Unlock()
+		}
+	}
+}
+
+// 服务端使用自己的logger记录用户文件和流量计数的错误
+func (db *UserDB) setLogger(logger *slog.Logger) {
+	db.mu.Lock()
+	db.logger = logger
+	db.mu.Unlock()
+}
+
+func (db *UserDB) log() *slog.Logger {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.logger == nil {
+		return slog.Default()
+	}
+	return db.logger
+}
+
+// 停止监视用户文件和定期写回流量计数
+func (db *UserDB) Close() {
+	db.bg.close()
+}
+
+// 读取加密的请求头, 用每个用户的密码尝试解密, 能通过校验的就是这个用户.
+// TAG用用户密码计算, 加密表相同的用户也能区分.
+// 只读取请求头本身, 之后的数据留给转发. 识别出用户但请求错误时同时返回用户和错误
+func (db *UserDB) ReadHeader(r io.Reader) (*User, *Socks5Resolution, error) {
+	db.mu.RLock()
+	users := db.users
+	db.mu.RUnlock()
+
+	frame, err := readHeaderFrame(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make([]byte, len(frame))
+	for _, u := range users {
+		copy(header, frame)
+		u.auth.Decrypt(header[headerLenPrefix:])
+		request, err := parseHeader(u.Passwd, header)
+		if err == ErrHeader {
+			continue
+		}
+		return u, request, err
+	}
+	return nil, nil, errors.New("未知用户")
+}
+
+func (db *UserDB) Status() []UserStatus {
+	db.mu.RLock()
+	users := db.users
+	db.mu.RUnlock()
+
+	var status []UserStatus
+	for _, u := range users {
+		u.stats.mu.Lock()
+		u.stats.quota.roll(time.Now())
+		quota := u.stats.quota
+		u.stats.mu.Unlock()
+		status = append(status, UserStatus{
+			Name:         u.Name,
+			Connections:  atomic.LoadInt64(&u.stats.connections),
+			Active:       atomic.LoadInt64(&u.stats.active),
+			BytesUp:      atomic.LoadInt64(&u.stats.up),
+			BytesDown:    atomic.LoadInt64(&u.stats.down),
+			DailyBytes:   quota.Daily,
+			MonthlyBytes: quota.Monthly,
+		})
+	}
+	return status
+}
@@ -0,0 +1,168 @@
+package socks5proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeUserFile(path string, content string) {
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func TestLoadUserDB(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sckpy-users")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+
+	for _, content := range []string{"", "# 注释\n", "alice random\n", "alice random a1\nalice random a2\n", "alice bad a1\n"} {
+		writeUserFile(path, content)
+		_, err = LoadUserDB(path)
+		assert.NotNil(t, err, content)
+	}
+
+	writeUserFile(path, "# 用户名 加密方法 密码\nalice random a1\n\nbob simple b2\n")
+	db, err := LoadUserDB(path)
+	assert.Nil(t, err)
+
+	request, err := BuildRequest(CMD_CONNECT, "example.com:443")
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		var u *User
+		for _, v := range db.users {
+			if v.Name == name {
+				u = v
+			}
+		}
+		header, err := BuildHeader(u.auth, u.Passwd, request)
+		assert.Nil(t, err)
+		found, parsed, err := db.ReadHeader(bytes.NewReader(header))
+		assert.Nil(t, err)
+		assert.Equal(t, name, found.Name)
+		assert.Equal(t, "example.com:443", parsed.Addr())
+	}
+
+	unknown, err := CreateAuth("random", "c3c3")
+	if err != nil {
+		log.Panic(err)
+	}
+	header, err := BuildHeader(unknown, "c3c3", request)
+	assert.Nil(t, err)
+	_, _, err = db.ReadHeader(bytes.NewReader(header))
+	assert.NotNil(t, err)
+
+	// 重新加载后统计保留
+	db.users[0].connect()
+	writeUserFile(path, "alice random a1\ncarol random c3c3\n")
+	assert.Nil(t, db.reload())
+	found, _, err := db.ReadHeader(bytes.NewReader(header))
+	assert.Nil(t, err)
+	assert.Equal(t, "carol", found.Name)
+	status := db.Status()
+	assert.Equal(t, 2, len(status))
+	assert.Equal(t, "alice", status[0].Name)
+	assert.Equal(t, int64(1), status[0].Connections)
+
+	// 加载失败时保留原来的用户
+	writeUserFile(path, "broken\n")
+	assert.NotNil(t, db.reload())
+	assert.Equal(t, 2, len(db.Status()))
+}
+
+func TestUserDBSamePasswdLength(t *testing.T) {
+	// 密码长度相同的用户靠请求头的TAG区分
+	db, err := ParseUserDB([]string{"alice random s3cret01", "bob random hunter22"})
+	assert.Nil(t, err)
+	request, _ := BuildRequest(CMD_CONNECT, "example.com:443")
+	for _, u := range db.users {
+		header, err := BuildHeader(u.auth, u.Passwd, request)
+		assert.Nil(t, err)
+		found, _, err := db.ReadHeader(bytes.NewReader(header))
+		assert.Nil(t, err)
+		assert.Equal(t, u.Name, found.Name)
+	}
+}
+
+func TestMultiUserServer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	dir, err := os.MkdirTemp("", "sckpy-users")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+	writeUserFile(path, "alice random abcedfg8\nbob simple abcedfg9\n")
+	db, err := LoadUserDB(path)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	serverAddr := startTestServer(t, ServerConfig{ServerOptions: ServerOptions{Users: db, ACL: loopbackACL}})
+
+	r, err := NewOutboundRouter(nil, nil, OutboundOptions{
+		Outbounds: []string{
+			"alice=server:random:abcedfg8@" + serverAddr,
+			"bob=server:simple:abcedfg9@" + serverAddr,
+			"eve=server:random:abcedfg@" + serverAddr,
+		},
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	addr := echo.Addr().String()
+	for _, name := range []string{"alice", "bob"} {
+		conn, err := r.outbounds[name].DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			log.Panic(err)
+		}
+		msg := []byte("hello " + name)
+		_, err = conn.Write(msg)
+		assert.Nil(t, err)
+		resp := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(conn, resp)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, resp)
+		conn.Close()
+	}
+
+	// 未知用户
+	_, err = r.outbounds["eve"].DialContext(context.Background(), "tcp", addr)
+	assert.NotNil(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+	for _, s := range db.Status() {
+		assert.Equal(t, int64(1), s.Connections, s.Name)
+		assert.Equal(t, int64(len("hello "+s.Name)), s.BytesUp, s.Name)
+	}
+}